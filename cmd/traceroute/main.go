@@ -2,30 +2,103 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"os"
 	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/visonhuo/mykit/pkg/ipasn"
+	"github.com/visonhuo/mykit/pkg/mmdb"
 	"github.com/visonhuo/mykit/pkg/traceroute"
 )
 
+var (
+	lookupNames = flag.Bool("resolve", false, "look up hostnames of hops by reverse DNS")
+	asnFile     = flag.String("asn", "", "`path` of prefix-to-ASN table (iptoasn TSV or pyasn data file) to look up AS of hops")
+	geoipFile   = flag.String("geoip", "", "`path` of MaxMind DB file (e.g. GeoLite2-City.mmdb) to look up location of hops")
+	report      = flag.Int("report", 0, "run `N` rounds and print statistics of hops like mtr report")
+	jsonOutput  = flag.Bool("json", false, "print results in JSON, one per line")
+	pmtu        = flag.Bool("pmtu", false, "discover path MTU along the path")
+	interval    = flag.Duration("interval", time.Second, "interval between rounds of report mode")
+	threshold   = flag.Duration("threshold", 10*time.Millisecond, "least RTT change of hops printed by diff")
+)
+
+var (
+	asnTable  *ipasn.Table
+	geoReader *mmdb.Reader
+)
+
+// geoLookup looks up locations of hops by MaxMind DB.
+type geoLookup struct {
+	reader *mmdb.Reader
+}
+
+func (l geoLookup) LookupLocation(ip net.IP) (traceroute.Location, bool) {
+	city, ok, err := l.reader.LookupCity(ip)
+	if err != nil || !ok {
+		return traceroute.Location{}, false
+	}
+	return traceroute.Location{Country: city.Country, City: city.City, Latitude: city.Latitude, Longitude: city.Longitude}, true
+}
+
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: traceroute host1 host2")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: traceroute [flags] host1 host2")
+		fmt.Fprintln(flag.CommandLine.Output(), "       traceroute [flags] diff old.json new.json")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		return
+	}
+	if flag.Arg(0) == "diff" {
+		if flag.NArg() != 3 {
+			flag.Usage()
+			return
+		}
+		printDiff(loadResult(flag.Arg(1)), loadResult(flag.Arg(2)))
 		return
 	}
 
+	if *asnFile != "" {
+		table, err := ipasn.LoadFile(*asnFile)
+		if err != nil {
+			log.Fatalf("Load ASN table failed: %v\n", err)
+		}
+		asnTable = table
+	}
+	if *geoipFile != "" {
+		reader, err := mmdb.Open(*geoipFile)
+		if err != nil {
+			log.Fatalf("Open GeoIP database failed: %v\n", err)
+		}
+		geoReader = reader
+	}
+
 	srv, err := traceroute.NewServer(traceroute.Config{})
 	if err != nil {
 		log.Fatalf("Create traceroute server failed: %v\n", err)
 	}
 	defer srv.Shutdown()
 
-	hosts := os.Args[1:]
+	hosts := flag.Args()
+	if *report > 0 {
+		for i := range hosts {
+			printReport(srv, hosts[i], *report)
+		}
+		return
+	}
 	results := make(map[string]*traceroute.Future, len(hosts))
 	for i := range hosts {
-		future, err := srv.Traceroute(context.Background(), hosts[i], traceroute.Options{})
+		future, err := srv.Traceroute(context.Background(), hosts[i], traceroute.Options{LookupNames: *lookupNames, PMTU: *pmtu})
 		if err != nil {
 			fmt.Println("Invalid host name: ", hosts[i])
 			continue
@@ -38,7 +111,11 @@ func main() {
 		if !ok {
 			continue
 		}
-		printResult(hosts[i], future)
+		if *jsonOutput {
+			printJSON(future)
+		} else {
+			printResult(hosts[i], future)
+		}
 	}
 }
 
@@ -55,14 +132,274 @@ func printResult(host string, future *traceroute.Future) {
 	sort.Slice(result.Hops, func(i, j int) bool {
 		return result.Hops[i].TTL < result.Hops[j].TTL
 	})
+	enrich(&result)
 	for i := range result.Hops {
-		fmt.Printf(" %d", i+1)
-		for j := range result.Hops[i].Nodes {
-			fmt.Printf("\t%v", result.Hops[i].Nodes[j].IP)
-			for k := range result.Hops[i].Nodes[j].RTTs {
-				fmt.Printf("\t%.3f ms", float64(result.Hops[i].Nodes[j].RTTs[k].Microseconds())/1000)
+		printHop(os.Stdout, result.Hops[i])
+	}
+	if asnTable != nil {
+		printASPath(result.ASPath())
+	}
+	if result.Opts.PMTU {
+		printPathMTU(result)
+	}
+}
+
+func printJSON(future *traceroute.Future) {
+	result := future.Result()
+	if err := future.Error(); err != nil {
+		log.Printf("Traceroute %v failed: %v\n", result.DstIP, err)
+		return
+	}
+	enrich(&result)
+	b, err := json.Marshal(result)
+	if err != nil {
+		log.Fatalf("Marshal result failed: %v\n", err)
+	}
+	fmt.Println(string(b))
+}
+
+// enrich fills AS and location of hops if the databases are loaded.
+func enrich(result *traceroute.Result) {
+	if asnTable != nil {
+		result.EnrichASN(asnTable)
+	}
+	if geoReader != nil {
+		result.EnrichGeo(geoLookup{reader: geoReader})
+	}
+}
+
+func printPathMTU(result traceroute.Result) {
+	fmt.Printf("Path MTU: %d\n", result.PathMTU)
+	for _, change := range result.MTUChanges {
+		fmt.Printf("  hop %d: MTU %d (reported by %v)\n", change.TTL, change.MTU, change.From)
+	}
+}
+
+func printASPath(path []traceroute.ASSegment) {
+	if len(path) == 0 {
+		return
+	}
+	fmt.Println("AS path:")
+	for i, seg := range path {
+		arrow := "  "
+		if i > 0 {
+			arrow = "->"
+		}
+		fmt.Printf(" %s AS%d %s (hops %d-%d)\n", arrow, seg.ASN, seg.ASName, seg.FirstTTL, seg.LastTTL)
+	}
+}
+
+// printHop prints the nodes replied to hop, with RTT and annotation of every
+// reply. The senders of "packet too big" errors in PMTU mode are printed as
+// well, even if they aren't nodes of hop.
+func printHop(w io.Writer, hop traceroute.Hop) {
+	fmt.Fprintf(w, " %d", hop.TTL)
+	nodes := append([]traceroute.Node(nil), hop.Nodes...)
+	for _, attempt := range hop.Attempts {
+		if attempt.Outcome == traceroute.OutcomeTooBig && !hasNode(nodes, attempt.From) {
+			nodes = append(nodes, traceroute.Node{IP: attempt.From})
+		}
+	}
+	if len(nodes) == 0 {
+		for range hop.Attempts {
+			fmt.Fprint(w, "\t*")
+		}
+		fmt.Fprintln(w)
+		return
+	}
+	for _, node := range nodes {
+		if node.Hostname != "" {
+			fmt.Fprintf(w, "\t%v (%v)", node.Hostname, node.IP)
+		} else {
+			fmt.Fprintf(w, "\t%v", node.IP)
+		}
+		if node.ASN != 0 {
+			fmt.Fprintf(w, " [AS%d]", node.ASN)
+		}
+		if location := node.Location; location != nil {
+			fmt.Fprintf(w, " [%s]", strings.TrimSpace(location.Country+" "+location.City))
+		}
+		for _, reply := range repliesOf(hop, node.IP) {
+			fmt.Fprintf(w, "\t%.3f ms", float64(reply.RTT.Microseconds())/1000)
+			if annotation := reply.Annotation(); annotation != "" {
+				fmt.Fprintf(w, " %s", annotation)
 			}
-			fmt.Println()
 		}
+		fmt.Fprintln(w)
+		printExtensions(w, hop, node.IP)
+	}
+	// unanswered probes of a partially replied hop
+	if lost := hop.Sent - hop.Received; lost > 0 {
+		fmt.Fprintf(w, "\t%s\n", strings.Repeat("* ", lost))
+	}
+}
+
+func hasNode(nodes []traceroute.Node, ip net.IP) bool {
+	for _, node := range nodes {
+		if node.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// repliesOf returns the replies from ip in sending order, including "packet
+// too big" errors in PMTU mode.
+func repliesOf(hop traceroute.Hop, ip net.IP) []traceroute.Attempt {
+	var replies []traceroute.Attempt
+	for _, attempt := range hop.Attempts {
+		if (attempt.Outcome == traceroute.OutcomeReply || attempt.Outcome == traceroute.OutcomeTooBig) && attempt.From.Equal(ip) {
+			replies = append(replies, attempt)
+		}
+	}
+	return replies
+}
+
+// printExtensions prints the MPLS labels and interfaces of the first reply
+// from ip, in the style of "traceroute -e".
+func printExtensions(w io.Writer, hop traceroute.Hop, ip net.IP) {
+	for _, attempt := range hop.Attempts {
+		if !attempt.From.Equal(ip) {
+			continue
+		}
+		for _, l := range attempt.MPLSLabels {
+			s := 0
+			if l.S {
+				s = 1
+			}
+			fmt.Fprintf(w, "\t  <MPLS:L=%d,E=%d,S=%d,T=%d>\n", l.Label, l.TC, s, l.TTL)
+		}
+		for _, iface := range attempt.Interfaces {
+			fmt.Fprintf(w, "\t  <%s:", iface.Role)
+			if iface.IfIndex != 0 {
+				fmt.Fprintf(w, " ifIndex=%d", iface.IfIndex)
+			}
+			if iface.Name != "" {
+				fmt.Fprintf(w, " name=%s", iface.Name)
+			}
+			if iface.IP != nil {
+				fmt.Fprintf(w, " ip=%v", iface.IP)
+			}
+			if iface.MTU != 0 {
+				fmt.Fprintf(w, " mtu=%d", iface.MTU)
+			}
+			fmt.Fprintln(w, ">")
+		}
+		return
+	}
+}
+
+// printReport monitors host for rounds, and prints the statistics like
+// "mtr --report", one probe is sent to every hop per round.
+func printReport(srv *traceroute.Server, host string, rounds int) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	snapshots, err := srv.Monitor(ctx, host, traceroute.Options{Attempts: 1}, *interval)
+	if err != nil {
+		fmt.Println("Invalid host name: ", host)
+		return
+	}
+	start := time.Now()
+	var last traceroute.Snapshot
+	for snapshot := range snapshots {
+		last = snapshot
+		if snapshot.Round >= rounds {
+			cancel()
+		}
+	}
+
+	localhost, _ := os.Hostname()
+	printSnapshot(os.Stdout, localhost, start, last)
+}
+
+// printSnapshot prints snapshot in the format of "mtr --report".
+func printSnapshot(w io.Writer, localhost string, start time.Time, snapshot traceroute.Snapshot) {
+	fmt.Fprintf(w, "Start: %s\n", start.Format(time.RFC3339))
+	fmt.Fprintf(w, "HOST: %-30s %6s %5s %6s %6s %6s %6s %6s\n", localhost, "Loss%", "Snt", "Last", "Avg", "Best", "Wrst", "StDev")
+	if snapshot.Err != nil {
+		fmt.Fprintln(w, "Error: ", snapshot.Err)
+	}
+	ms := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+	for _, hop := range snapshot.Hops {
+		name := "???"
+		if len(hop.IPs) > 0 {
+			name = hop.IPs[0].String()
+		}
+		fmt.Fprintf(w, "%3d.|-- %-30s %5.1f%% %5d %6.1f %6.1f %6.1f %6.1f %6.1f\n", hop.TTL, name, hop.Loss, hop.Sent,
+			ms(hop.Last), ms(hop.Avg), ms(hop.Best), ms(hop.Worst), ms(hop.StdDev))
+		for j := 1; j < len(hop.IPs); j++ { // load balanced
+			if j == 1 {
+				fmt.Fprintf(w, "    |  `|-- %v\n", hop.IPs[j])
+			} else {
+				fmt.Fprintf(w, "    |   +-- %v\n", hop.IPs[j])
+			}
+		}
+	}
+}
+
+// loadResult reads a result saved by -json, or the text output of classic
+// traceroute or "mtr --report".
+func loadResult(path string) traceroute.Result {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Read result failed: %v\n", err)
+	}
+	var result traceroute.Result
+	switch text := strings.TrimSpace(string(b)); {
+	case strings.HasPrefix(text, "{"):
+		err = json.Unmarshal(b, &result)
+	case strings.Contains(text, "|--"):
+		result, _, err = traceroute.ParseMTRReport(strings.NewReader(text))
+	default:
+		result, err = traceroute.ParseTraceroute(strings.NewReader(text))
+	}
+	if err != nil {
+		log.Fatalf("Parse result %s failed: %v\n", path, err)
+	}
+	return result
+}
+
+func printDiff(before, after traceroute.Result) {
+	d := traceroute.Diff(before, after, *threshold)
+	fmt.Printf("diff %v -> %v\n", before.DstIP, after.DstIP)
+	fmt.Printf("Path length: %d -> %d (%+d)\n", d.OldLength, d.NewLength, d.LengthDelta)
+	switch {
+	case d.Unreachable:
+		fmt.Println("Destination became unreachable")
+	case !d.OldReach && d.NewReach:
+		fmt.Println("Destination became reachable")
+	case !d.NewReach:
+		fmt.Println("Destination is unreachable")
+	}
+
+	ttl := func(ttl int) string {
+		if ttl == 0 {
+			return "-"
+		}
+		return strconv.Itoa(ttl)
+	}
+	ips := func(ips []net.IP) string {
+		s := make([]string, len(ips))
+		for i, ip := range ips {
+			s[i] = ip.String()
+		}
+		return strings.Join(s, ", ")
+	}
+	if !d.RouteChanged() {
+		fmt.Println("Route unchanged")
+	}
+	for _, hop := range d.Hops {
+		switch hop.Change {
+		case traceroute.HopAdded:
+			fmt.Printf("+ %3s %3s  %s\n", "", ttl(hop.NewTTL), ips(hop.NewIPs))
+		case traceroute.HopRemoved:
+			fmt.Printf("- %3s %3s  %s\n", ttl(hop.OldTTL), "", ips(hop.OldIPs))
+		default:
+			fmt.Printf("~ %3s %3s  %s -> %s\n", ttl(hop.OldTTL), ttl(hop.NewTTL), ips(hop.OldIPs), ips(hop.NewIPs))
+		}
+	}
+	for _, delta := range d.RTTDeltas {
+		fmt.Printf("RTT %3s %3s  %v: %v -> %v (%+.3f ms)\n", ttl(delta.OldTTL), ttl(delta.NewTTL), delta.IP,
+			delta.Old, delta.New, float64(delta.Delta.Microseconds())/1000)
 	}
 }
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/visonhuo/mykit/pkg/traceroute"
+)
+
+func TestPrintHop_PMTU(t *testing.T) {
+	router, dst := net.ParseIP("10.0.1.1"), net.ParseIP("10.0.2.1")
+	hop := traceroute.Hop{
+		TTL: 3,
+		Nodes: []traceroute.Node{
+			{IP: dst, RTTs: []time.Duration{3 * time.Millisecond}, Sent: 1, Received: 1},
+		},
+		Attempts: []traceroute.Attempt{
+			{Outcome: traceroute.OutcomeTooBig, From: router, RTT: 2 * time.Millisecond, ICMPType: 3, ICMPCode: 4, MTU: 1400},
+			{Outcome: traceroute.OutcomeReply, From: dst, RTT: 3 * time.Millisecond, ICMPType: 3, ICMPCode: 3},
+		},
+		Sent:     1,
+		Received: 1,
+	}
+
+	var buf bytes.Buffer
+	printHop(&buf, hop)
+	require.Equal(t, " 3\t10.0.2.1\t3.000 ms\n\t10.0.1.1\t2.000 ms !F-1400\n", buf.String())
+}
+
+func TestPrintHop_Timeout(t *testing.T) {
+	hop := traceroute.Hop{
+		TTL:      2,
+		Attempts: []traceroute.Attempt{{Outcome: traceroute.OutcomeTimeout}, {Outcome: traceroute.OutcomeTimeout}},
+		Sent:     2,
+	}
+	var buf bytes.Buffer
+	printHop(&buf, hop)
+	require.Equal(t, " 2\t*\t*\n", buf.String())
+}
+
+func TestPrintSnapshot(t *testing.T) {
+	snapshot := traceroute.Snapshot{Round: 10, Reach: true, Hops: []traceroute.HopSummary{
+		{TTL: 1, IPs: []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.3")},
+			Sent: 10, Received: 10, Last: time.Millisecond, Avg: time.Millisecond, Best: time.Millisecond, Worst: time.Millisecond},
+		{TTL: 2, Sent: 10, Loss: 100},
+	}}
+	var buf bytes.Buffer
+	printSnapshot(&buf, "myhost", time.Date(2022, 10, 17, 10, 0, 0, 0, time.UTC), snapshot)
+	require.Contains(t, buf.String(), "\n    |  `|-- 10.0.0.2\n    |   +-- 10.0.0.3\n")
+
+	// report is parsed back as mtr report
+	_, summaries, err := traceroute.ParseMTRReport(&buf)
+	require.NoError(t, err)
+	require.Len(t, summaries, 2)
+	require.Equal(t, snapshot.Hops[0].IPs, summaries[0].IPs)
+	require.Equal(t, 100.0, summaries[1].Loss)
+}
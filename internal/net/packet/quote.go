@@ -0,0 +1,99 @@
+package packet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+const (
+	protocolICMPv4 = 1
+	protocolTCP    = 6
+	protocolUDP    = 17
+	protocolICMPv6 = 58
+
+	ipv4HeaderLen = 20
+	ipv6HeaderLen = 40
+	// quotedTransportLen is the length of transport header guaranteed to be
+	// quoted by ICMP error messages (RFC 792).
+	quotedTransportLen = 8
+)
+
+// Quote is the original datagram quoted in the data of ICMP Time Exceeded or
+// Destination Unreachable message, that is the IP header and at least the
+// first 8 bytes of transport header.
+type Quote struct {
+	Version  int
+	ID       int // identification, only available for IPv4
+	TTL      int // remaining TTL (or hop limit) of original datagram
+	Protocol int // IANA protocol number of transport header
+	Src      net.IP
+	Dst      net.IP
+	// Transport reports whether the transport header is quoted, which is
+	// required by the following fields.
+	Transport bool
+	SrcPort   uint16 // UDP and TCP only
+	DstPort   uint16 // UDP and TCP only
+	Checksum  uint16 // UDP and ICMP only
+	Seq       uint32 // TCP only
+	EchoID    uint16 // ICMP echo only
+	EchoSeq   uint16 // ICMP echo only
+}
+
+// ParseQuote parses the quoted datagram b of ICMPv4 or ICMPv6 error message.
+// Truncated transport header isn't an error, Quote.Transport is false then.
+func ParseQuote(b []byte) (Quote, error) {
+	if len(b) == 0 {
+		return Quote{}, errors.New("empty quoted datagram")
+	}
+
+	var q Quote
+	var transport []byte
+	switch q.Version = int(b[0] >> 4); q.Version {
+	case 4:
+		hdrLen := int(b[0]&0x0f) << 2
+		if hdrLen < ipv4HeaderLen || len(b) < hdrLen {
+			return Quote{}, fmt.Errorf("invalid IPv4 header length: %d", hdrLen)
+		}
+		q.ID = int(binary.BigEndian.Uint16(b[4:6]))
+		q.TTL = int(b[8])
+		q.Protocol = int(b[9])
+		q.Src = net.IP(append([]byte(nil), b[12:16]...))
+		q.Dst = net.IP(append([]byte(nil), b[16:20]...))
+		transport = b[hdrLen:]
+	case 6:
+		if len(b) < ipv6HeaderLen {
+			return Quote{}, fmt.Errorf("invalid IPv6 header length: %d", len(b))
+		}
+		q.Protocol = int(b[6])
+		q.TTL = int(b[7])
+		q.Src = net.IP(append([]byte(nil), b[8:24]...))
+		q.Dst = net.IP(append([]byte(nil), b[24:40]...))
+		transport = b[ipv6HeaderLen:]
+	default:
+		return Quote{}, fmt.Errorf("invalid IP version: %d", q.Version)
+	}
+
+	if len(transport) < quotedTransportLen {
+		return q, nil
+	}
+	switch q.Protocol {
+	case protocolUDP:
+		q.SrcPort = binary.BigEndian.Uint16(transport[0:2])
+		q.DstPort = binary.BigEndian.Uint16(transport[2:4])
+		q.Checksum = binary.BigEndian.Uint16(transport[6:8])
+	case protocolTCP:
+		q.SrcPort = binary.BigEndian.Uint16(transport[0:2])
+		q.DstPort = binary.BigEndian.Uint16(transport[2:4])
+		q.Seq = binary.BigEndian.Uint32(transport[4:8])
+	case protocolICMPv4, protocolICMPv6:
+		q.Checksum = binary.BigEndian.Uint16(transport[2:4])
+		q.EchoID = binary.BigEndian.Uint16(transport[4:6])
+		q.EchoSeq = binary.BigEndian.Uint16(transport[6:8])
+	default:
+		return q, nil
+	}
+	q.Transport = true
+	return q, nil
+}
@@ -0,0 +1,100 @@
+package packet_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/visonhuo/mykit/internal/net/packet"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+func quoteIPv4(t *testing.T, header ipv4.Header, transport []byte) []byte {
+	header.Version, header.Len = ipv4.Version, ipv4.HeaderLen
+	header.TotalLen = ipv4.HeaderLen + len(transport)
+	b, err := header.Marshal()
+	require.NoError(t, err)
+	return append(b, transport...)
+}
+
+func TestParseQuote(t *testing.T) {
+	src, dst := net.ParseIP("10.2.64.100"), net.ParseIP("8.8.8.8")
+	header := ipv4.Header{ID: 7, TTL: 1, Src: src, Dst: dst}
+
+	header.Protocol = 17
+	udp := packet.UDPv4{SrcPort: 8080, DstPort: 33435}
+	udpBytes, err := udp.Marshal(header, make([]byte, 8))
+	require.NoError(t, err)
+	quote, err := packet.ParseQuote(quoteIPv4(t, header, udpBytes))
+	require.NoError(t, err)
+	require.True(t, quote.Transport)
+	require.Equal(t, 4, quote.Version)
+	require.Equal(t, 7, quote.ID)
+	require.Equal(t, 1, quote.TTL)
+	require.Equal(t, 17, quote.Protocol)
+	require.True(t, quote.Src.Equal(src))
+	require.True(t, quote.Dst.Equal(dst))
+	require.Equal(t, uint16(8080), quote.SrcPort)
+	require.Equal(t, uint16(33435), quote.DstPort)
+	require.NotZero(t, quote.Checksum)
+
+	header.Protocol = 6
+	tcp := packet.TCPv4{SrcPort: 8080, DstPort: 443, Seq: 3, Flags: packet.TCPFlagSYN}
+	tcpBytes, err := tcp.Marshal(header, nil)
+	require.NoError(t, err)
+	quote, err = packet.ParseQuote(quoteIPv4(t, header, tcpBytes[:8])) // only 8 bytes quoted
+	require.NoError(t, err)
+	require.True(t, quote.Transport)
+	require.Equal(t, uint16(8080), quote.SrcPort)
+	require.Equal(t, uint16(443), quote.DstPort)
+	require.Equal(t, uint32(3), quote.Seq)
+
+	header.Protocol = 1
+	echo := icmp.Message{Type: ipv4.ICMPTypeEcho, Body: &icmp.Echo{ID: 8080, Seq: 5}}
+	echoBytes, err := echo.Marshal(nil)
+	require.NoError(t, err)
+	quote, err = packet.ParseQuote(quoteIPv4(t, header, echoBytes))
+	require.NoError(t, err)
+	require.True(t, quote.Transport)
+	require.Equal(t, uint16(8080), quote.EchoID)
+	require.Equal(t, uint16(5), quote.EchoSeq)
+
+	// truncated transport header falls back to IP header only
+	quote, err = packet.ParseQuote(quoteIPv4(t, header, echoBytes[:4]))
+	require.NoError(t, err)
+	require.False(t, quote.Transport)
+	require.Equal(t, 7, quote.ID)
+
+	_, err = packet.ParseQuote([]byte{0x45, 0})
+	require.Error(t, err)
+	_, err = packet.ParseQuote(nil)
+	require.Error(t, err)
+}
+
+func TestParseQuote_IPv6(t *testing.T) {
+	header := ipv6.Header{
+		NextHeader: 17,
+		HopLimit:   2,
+		Src:        net.ParseIP("2001:db8::100"),
+		Dst:        net.ParseIP("2001:4860:4860::8888"),
+	}
+	udp := packet.UDPv6{SrcPort: 8080, DstPort: 33436}
+	udpBytes, err := udp.Marshal(header, make([]byte, 8))
+	require.NoError(t, err)
+
+	b := make([]byte, ipv6.HeaderLen, ipv6.HeaderLen+len(udpBytes))
+	b[0] = ipv6.Version << 4
+	b[6], b[7] = byte(header.NextHeader), byte(header.HopLimit)
+	copy(b[8:24], header.Src)
+	copy(b[24:40], header.Dst)
+	quote, err := packet.ParseQuote(append(b, udpBytes...))
+	require.NoError(t, err)
+	require.True(t, quote.Transport)
+	require.Equal(t, 6, quote.Version)
+	require.Equal(t, 2, quote.TTL)
+	require.True(t, quote.Dst.Equal(header.Dst))
+	require.Equal(t, uint16(8080), quote.SrcPort)
+	require.Equal(t, uint16(33436), quote.DstPort)
+}
@@ -0,0 +1,188 @@
+package packet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	TCPFlagFIN uint8 = 1 << iota
+	TCPFlagSYN
+	TCPFlagRST
+	TCPFlagPSH
+	TCPFlagACK
+	TCPFlagURG
+)
+
+const (
+	TCPOptionEOL = 0
+	TCPOptionNOP = 1
+	TCPOptionMSS = 2
+)
+
+const (
+	tcpHeaderLen       = 20
+	tcpMaxOptionsLen   = 40
+	tcpDefaultWindow   = 65535
+	tcpDataOffsetShift = 4
+)
+
+type TCPOption struct {
+	Kind uint8
+	Data []byte
+}
+
+type TCPv4 struct {
+	SrcPort uint16
+	DstPort uint16
+	Seq     uint32
+	Ack     uint32
+	Flags   uint8
+	Window  uint16
+	Urgent  uint16
+	Options []TCPOption
+	csum    uint16
+}
+
+type tcpHeader struct {
+	SrcPort    uint16
+	DstPort    uint16
+	Seq        uint32
+	Ack        uint32
+	DataOffset uint8
+	Flags      uint8
+	Window     uint16
+	Csum       uint16
+	Urgent     uint16
+}
+
+func (t *TCPv4) Marshal(ipHeader ipv4.Header, payload []byte) ([]byte, error) {
+	options, err := t.marshalOptions()
+	if err != nil {
+		return nil, err
+	}
+	err = t.checkSum(ipHeader, options, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	_ = binary.Write(&b, binary.BigEndian, t.header(options))
+	_ = binary.Write(&b, binary.BigEndian, options)
+	_ = binary.Write(&b, binary.BigEndian, payload)
+	return b.Bytes(), nil
+}
+
+// Unmarshal parses the fixed TCP header and options in b, payload is ignored.
+func (t *TCPv4) Unmarshal(b []byte) error {
+	if len(b) < tcpHeaderLen {
+		return fmt.Errorf("tcp header too short: %d", len(b))
+	}
+	var h tcpHeader
+	_ = binary.Read(bytes.NewReader(b[:tcpHeaderLen]), binary.BigEndian, &h)
+	hdrLen := int(h.DataOffset>>tcpDataOffsetShift) * 4
+	if hdrLen < tcpHeaderLen || hdrLen > len(b) {
+		return fmt.Errorf("invalid tcp data offset: %d", hdrLen)
+	}
+
+	t.SrcPort, t.DstPort = h.SrcPort, h.DstPort
+	t.Seq, t.Ack = h.Seq, h.Ack
+	t.Flags, t.Window, t.Urgent = h.Flags, h.Window, h.Urgent
+	t.csum = h.Csum
+	t.Options = t.Options[:0]
+	for opts := b[tcpHeaderLen:hdrLen]; len(opts) > 0; {
+		kind := opts[0]
+		if kind == TCPOptionEOL {
+			break
+		}
+		if kind == TCPOptionNOP {
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || int(opts[1]) < 2 || int(opts[1]) > len(opts) {
+			return errors.New("malformed tcp option")
+		}
+		t.Options = append(t.Options, TCPOption{Kind: kind, Data: append([]byte(nil), opts[2:opts[1]]...)})
+		opts = opts[opts[1]:]
+	}
+	return nil
+}
+
+func (t *TCPv4) HasFlags(flags uint8) bool {
+	return t.Flags&flags == flags
+}
+
+func (t *TCPv4) header(options []byte) tcpHeader {
+	window := t.Window
+	if window == 0 {
+		window = tcpDefaultWindow
+	}
+	return tcpHeader{
+		SrcPort:    t.SrcPort,
+		DstPort:    t.DstPort,
+		Seq:        t.Seq,
+		Ack:        t.Ack,
+		DataOffset: uint8((tcpHeaderLen+len(options))/4) << tcpDataOffsetShift,
+		Flags:      t.Flags,
+		Window:     window,
+		Csum:       t.csum,
+		Urgent:     t.Urgent,
+	}
+}
+
+func (t *TCPv4) marshalOptions() ([]byte, error) {
+	var b []byte
+	for _, opt := range t.Options {
+		if opt.Kind == TCPOptionEOL || opt.Kind == TCPOptionNOP {
+			b = append(b, opt.Kind)
+			continue
+		}
+		b = append(b, opt.Kind, uint8(2+len(opt.Data)))
+		b = append(b, opt.Data...)
+	}
+	for len(b)%4 != 0 { // pad with EOL to 32-bit boundary
+		b = append(b, TCPOptionEOL)
+	}
+	if len(b) > tcpMaxOptionsLen {
+		return nil, fmt.Errorf("tcp options too long: %d", len(b))
+	}
+	return b, nil
+}
+
+func (t *TCPv4) checkSum(ipHeader ipv4.Header, options, payload []byte) error {
+	t.csum = 0
+	if ipHeader.Src.To4() == nil {
+		return fmt.Errorf("invalid src ip: %v", ipHeader.Src)
+	}
+	if ipHeader.Dst.To4() == nil {
+		return fmt.Errorf("invalid dst ip: %v", ipHeader.Dst)
+	}
+
+	srcIP := ([]byte)(ipHeader.Src.To4())
+	dstIP := ([]byte)(ipHeader.Dst.To4())
+	ph := pseudoHeader{
+		srcIP: [4]byte{srcIP[0], srcIP[1], srcIP[2], srcIP[3]},
+		dstIP: [4]byte{dstIP[0], dstIP[1], dstIP[2], dstIP[3]},
+		zero:  0,
+		proto: uint8(ipHeader.Protocol),
+		len:   uint16(tcpHeaderLen + len(options) + len(payload)),
+	}
+	var b bytes.Buffer
+	_ = binary.Write(&b, binary.BigEndian, &ph)
+	_ = binary.Write(&b, binary.BigEndian, t.header(options))
+	_ = binary.Write(&b, binary.BigEndian, options)
+	_ = binary.Write(&b, binary.BigEndian, payload)
+	t.csum = checksum(b.Bytes())
+	return nil
+}
+
+// MSSOption returns a TCP maximum segment size option.
+func MSSOption(mss uint16) TCPOption {
+	data := make([]byte, 2)
+	binary.BigEndian.PutUint16(data, mss)
+	return TCPOption{Kind: TCPOptionMSS, Data: data}
+}
@@ -0,0 +1,47 @@
+package packet_test
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/visonhuo/mykit/internal/net/packet"
+	"golang.org/x/net/ipv4"
+)
+
+func TestTCPv4_Marshal(t *testing.T) {
+	tcp := packet.TCPv4{
+		SrcPort: 8080,
+		DstPort: 443,
+		Seq:     1,
+		Flags:   packet.TCPFlagSYN,
+		Options: []packet.TCPOption{packet.MSSOption(1460)},
+	}
+	header := ipv4.Header{
+		Protocol: 6, // tcp protocol
+		Src:      net.ParseIP("10.2.64.100"),
+		Dst:      net.ParseIP("8.8.8.8"),
+	}
+
+	tcpBytes, err := tcp.Marshal(header, nil)
+	require.NoError(t, err)
+	require.Len(t, tcpBytes, 24)
+	require.Equal(t, tcp.SrcPort, binary.BigEndian.Uint16(tcpBytes[:2]))
+	require.Equal(t, tcp.DstPort, binary.BigEndian.Uint16(tcpBytes[2:4]))
+	require.Equal(t, tcp.Seq, binary.BigEndian.Uint32(tcpBytes[4:8]))
+	require.Equal(t, uint8(6<<4), tcpBytes[12])
+	require.Equal(t, packet.TCPFlagSYN, tcpBytes[13])
+	require.Equal(t, uint16(0x1c65), binary.BigEndian.Uint16(tcpBytes[16:18]))
+
+	var parsed packet.TCPv4
+	require.NoError(t, parsed.Unmarshal(tcpBytes))
+	require.Equal(t, tcp.SrcPort, parsed.SrcPort)
+	require.Equal(t, tcp.DstPort, parsed.DstPort)
+	require.Equal(t, tcp.Seq, parsed.Seq)
+	require.True(t, parsed.HasFlags(packet.TCPFlagSYN))
+	require.False(t, parsed.HasFlags(packet.TCPFlagSYN|packet.TCPFlagACK))
+	require.Equal(t, tcp.Options, parsed.Options)
+
+	require.Error(t, parsed.Unmarshal(tcpBytes[:12]))
+}
@@ -4,7 +4,10 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"net"
+
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 type UDPv4 struct {
@@ -67,6 +70,74 @@ func (u *UDPv4) checkSum(ipHeader ipv4.Header, payload []byte) error {
 	return nil
 }
 
+type UDPv6 struct {
+	SrcPort uint16
+	DstPort uint16
+	length  uint16
+	csum    uint16
+}
+
+type pseudoHeaderV6 struct {
+	srcIP [16]byte
+	dstIP [16]byte
+	len   uint32
+	zero  [3]uint8
+	next  uint8
+}
+
+func (u *UDPv6) Marshal(ipHeader ipv6.Header, payload []byte) ([]byte, error) {
+	err := u.checkSum(ipHeader, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	err = binary.Write(&b, binary.BigEndian, u)
+	if err != nil {
+		return nil, err
+	}
+	err = binary.Write(&b, binary.BigEndian, payload)
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (u *UDPv6) checkSum(ipHeader ipv6.Header, payload []byte) error {
+	u.csum = 0
+	if len(ipHeader.Src.To16()) != net.IPv6len || ipHeader.Src.To4() != nil {
+		return fmt.Errorf("invalid src ip: %v", ipHeader.Src)
+	}
+	if len(ipHeader.Dst.To16()) != net.IPv6len || ipHeader.Dst.To4() != nil {
+		return fmt.Errorf("invalid dst ip: %v", ipHeader.Dst)
+	}
+
+	u.length = uint16(8 + len(payload)) // UDP header length = 8
+	ph := pseudoHeaderV6{
+		len:  uint32(u.length),
+		next: uint8(ipHeader.NextHeader),
+	}
+	copy(ph.srcIP[:], ipHeader.Src.To16())
+	copy(ph.dstIP[:], ipHeader.Dst.To16())
+	var b bytes.Buffer
+	_ = binary.Write(&b, binary.BigEndian, &ph)
+	_ = binary.Write(&b, binary.BigEndian, u)
+	_ = binary.Write(&b, binary.BigEndian, &payload)
+	u.csum = checksum(b.Bytes())
+	return nil
+}
+
+// ChecksumPatch returns the 16-bit word which, written over a zeroed and 2-byte
+// aligned word of the checksummed data, turns checksum csum into want. It lets
+// callers carry information in the checksum field by tweaking the payload.
+func ChecksumPatch(csum, want uint16) uint16 {
+	sum := uint32(^want) + uint32(csum)
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return uint16(sum)
+}
+
 func checksum(buf []byte) uint16 {
 	sum := uint32(0)
 
@@ -8,6 +8,7 @@ import (
 	"github.com/stretchr/testify/require"
 	"github.com/visonhuo/mykit/internal/net/packet"
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 func TestUDPv4_Marshal(t *testing.T) {
@@ -31,3 +32,47 @@ func TestUDPv4_Marshal(t *testing.T) {
 	require.Equal(t, uint16(0x6246), binary.BigEndian.Uint16(udpBytes[6:8]))
 	require.Len(t, udpBytes[8:], 8)
 }
+
+func TestUDPv6_Marshal(t *testing.T) {
+	udp := packet.UDPv6{
+		SrcPort: 8080,
+		DstPort: 9090,
+	}
+	header := ipv6.Header{
+		NextHeader: 17, // udp protocol
+		Src:        net.ParseIP("2001:db8::100"),
+		Dst:        net.ParseIP("2001:4860:4860::8888"),
+	}
+	payload := make([]byte, 8)
+
+	udpBytes, err := udp.Marshal(header, payload)
+	require.NoError(t, err)
+	require.Equal(t, udp.SrcPort, binary.BigEndian.Uint16(udpBytes[:2]))
+	require.Equal(t, udp.DstPort, binary.BigEndian.Uint16(udpBytes[2:4]))
+	require.Equal(t, uint16(16), binary.BigEndian.Uint16(udpBytes[4:6]))
+	require.Equal(t, uint16(0x54b9), binary.BigEndian.Uint16(udpBytes[6:8]))
+	require.Len(t, udpBytes[8:], 8)
+
+	_, err = udp.Marshal(ipv6.Header{Src: net.ParseIP("10.2.64.100"), Dst: header.Dst}, payload)
+	require.Error(t, err)
+}
+
+func TestChecksumPatch(t *testing.T) {
+	header := ipv4.Header{
+		Protocol: 17, // udp protocol
+		Src:      net.ParseIP("10.2.64.100"),
+		Dst:      net.ParseIP("8.8.8.8"),
+	}
+	for _, want := range []uint16{1, 2, 0x1234, 0x6246, 0xfffe, 0xffff} {
+		udp := packet.UDPv4{SrcPort: 8080, DstPort: 9090}
+		payload := make([]byte, 8)
+		udpBytes, err := udp.Marshal(header, payload)
+		require.NoError(t, err)
+
+		patch := packet.ChecksumPatch(binary.BigEndian.Uint16(udpBytes[6:8]), want)
+		binary.BigEndian.PutUint16(payload, patch)
+		udpBytes, err = udp.Marshal(header, payload)
+		require.NoError(t, err)
+		require.Equal(t, want, binary.BigEndian.Uint16(udpBytes[6:8]))
+	}
+}
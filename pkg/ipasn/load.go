@@ -0,0 +1,137 @@
+package ipasn
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// LoadIPToASN loads the iptoasn.com TSV table (ip2asn-combined.tsv), whose
+// lines are "range_start range_end AS_number country_code AS_description"
+// separated by tab. Ranges of AS number 0 (not routed) are skipped.
+func LoadIPToASN(r io.Reader) (*Table, error) {
+	t := NewTable()
+	err := scanLines(r, func(line string) error {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 3 {
+			return fmt.Errorf("invalid line: %q", line)
+		}
+		start, end := net.ParseIP(fields[0]), net.ParseIP(fields[1])
+		if start == nil || end == nil {
+			return fmt.Errorf("invalid range: %q", line)
+		}
+		if start4, end4 := start.To4(), end.To4(); start4 != nil && end4 != nil {
+			start, end = start4, end4
+		} else if start4 != nil || end4 != nil {
+			return fmt.Errorf("mixed address family: %q", line)
+		}
+		number, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid AS number: %q", line)
+		}
+		if number == 0 {
+			return nil
+		}
+
+		as := AS{Number: uint32(number)}
+		if len(fields) > 3 && fields[3] != "None" {
+			as.Country = fields[3]
+		}
+		if len(fields) > 4 {
+			as.Name = fields[4]
+		}
+		for _, prefix := range rangePrefixes(start, end) {
+			if err := t.Insert(prefix, as); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// LoadPyASN loads the pyasn IPASN data file, whose lines are "prefix AS_number"
+// separated by tab, and lines starting with ';' are comments. The file carries
+// no AS names.
+func LoadPyASN(r io.Reader) (*Table, error) {
+	t := NewTable()
+	err := scanLines(r, func(line string) error {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return fmt.Errorf("invalid line: %q", line)
+		}
+		_, prefix, err := net.ParseCIDR(fields[0])
+		if err != nil {
+			return fmt.Errorf("invalid prefix: %q", line)
+		}
+		number, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid AS number: %q", line)
+		}
+		return t.Insert(prefix, AS{Number: uint32(number)})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// LoadFile loads the table file of path, either the iptoasn TSV or pyasn data
+// file, which is detected by its first line. Gzip compressed file is accepted
+// as well.
+func LoadFile(path string) (*Table, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		r = gr
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var first string
+	_ = scanLines(bytes.NewReader(data), func(line string) error {
+		first = line
+		return io.EOF
+	})
+	if fields := strings.Fields(first); len(fields) > 0 && strings.Contains(fields[0], "/") {
+		return LoadPyASN(bytes.NewReader(data))
+	}
+	return LoadIPToASN(bytes.NewReader(data))
+}
+
+// scanLines calls fn with every line of r, except blank and comment lines.
+func scanLines(r io.Reader, fn func(line string) error) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if trimmed := strings.TrimSpace(line); trimmed == "" || trimmed[0] == ';' || trimmed[0] == '#' {
+			continue
+		}
+		if err := fn(line); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,170 @@
+// Package ipasn maps IP addresses to autonomous systems (AS) offline, by a
+// local prefix-to-ASN table such as the iptoasn.com TSV or a pyasn dump.
+package ipasn
+
+import (
+	"errors"
+	"net"
+)
+
+// AS is an autonomous system.
+type AS struct {
+	Number  uint32
+	Name    string
+	Country string // ISO 3166 country code, if known
+}
+
+type trieNode struct {
+	children [2]*trieNode
+	as       *AS
+}
+
+// Table maps IPv4 and IPv6 prefixes to autonomous systems, addresses are
+// looked up by longest prefix match. Table isn't safe for concurrent
+// modification, but it's safe for concurrent lookups once loaded.
+type Table struct {
+	v4  trieNode
+	v6  trieNode
+	len int
+}
+
+func NewTable() *Table {
+	return &Table{}
+}
+
+// Len returns the number of prefixes in table.
+func (t *Table) Len() int {
+	return t.len
+}
+
+// Insert maps prefix to as, the existing mapping of the same prefix is
+// replaced. IPv4-mapped IPv6 prefix is inserted as IPv4 one.
+func (t *Table) Insert(prefix *net.IPNet, as AS) error {
+	ip, root := t.root(prefix.IP)
+	if root == nil {
+		return errors.New("invalid prefix address")
+	}
+	ones, bits := prefix.Mask.Size()
+	if len(ip) == net.IPv4len && bits == 8*net.IPv6len && ones >= 96 {
+		ones, bits = ones-96, 32 // IPv4-mapped IPv6 prefix
+	}
+	if bits != len(ip)*8 {
+		return errors.New("invalid prefix mask")
+	}
+
+	node := root
+	for i := 0; i < ones; i++ {
+		b := bit(ip, i)
+		if node.children[b] == nil {
+			node.children[b] = &trieNode{}
+		}
+		node = node.children[b]
+	}
+	if node.as == nil {
+		t.len++
+	}
+	node.as = &as
+	return nil
+}
+
+// Lookup returns the AS of the longest prefix matching ip.
+func (t *Table) Lookup(ip net.IP) (AS, bool) {
+	ip, node := t.root(ip)
+	if node == nil {
+		return AS{}, false
+	}
+
+	var found *AS
+	for i := 0; node != nil; i++ {
+		if node.as != nil {
+			found = node.as
+		}
+		if i == len(ip)*8 {
+			break
+		}
+		node = node.children[bit(ip, i)]
+	}
+	if found == nil {
+		return AS{}, false
+	}
+	return *found, true
+}
+
+// LookupASN returns the AS number and name of ip, it implements
+// traceroute.ASNLookup.
+func (t *Table) LookupASN(ip net.IP) (uint32, string, bool) {
+	as, ok := t.Lookup(ip)
+	return as.Number, as.Name, ok
+}
+
+func (t *Table) root(ip net.IP) (net.IP, *trieNode) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4, &t.v4
+	}
+	if ip16 := ip.To16(); ip16 != nil {
+		return ip16, &t.v6
+	}
+	return nil, nil
+}
+
+func bit(ip net.IP, i int) int {
+	return int(ip[i/8]>>(7-uint(i%8))) & 1
+}
+
+// rangePrefixes returns the minimal prefixes covering addresses from start to
+// end inclusively, both of them must have the same length.
+func rangePrefixes(start, end net.IP) []*net.IPNet {
+	bits := len(start) * 8
+	cur := append(net.IP(nil), start...)
+	var prefixes []*net.IPNet
+	for compare(cur, end) <= 0 {
+		// expand host bits as long as prefix is aligned and within range
+		host := 0
+		for host < bits && bit(cur, bits-1-host) == 0 && compare(lastAddr(cur, host+1), end) <= 0 {
+			host++
+		}
+		prefixes = append(prefixes, &net.IPNet{
+			IP:   append(net.IP(nil), cur...),
+			Mask: net.CIDRMask(bits-host, bits),
+		})
+
+		last := lastAddr(cur, host)
+		if !increase(last) {
+			break // overflow after the last address
+		}
+		cur = last
+	}
+	return prefixes
+}
+
+// lastAddr returns the last address of prefix starting at ip with host bits.
+func lastAddr(ip net.IP, host int) net.IP {
+	last := append(net.IP(nil), ip...)
+	for i := 0; i < host; i++ {
+		last[len(last)-1-i/8] |= 1 << uint(i%8)
+	}
+	return last
+}
+
+// increase adds one to ip in place, it returns false on overflow.
+func increase(ip net.IP) bool {
+	for i := len(ip) - 1; i >= 0; i-- {
+		ip[i]++
+		if ip[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func compare(a, b net.IP) int {
+	for i := range a {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
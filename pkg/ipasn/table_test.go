@@ -0,0 +1,114 @@
+package ipasn_test
+
+import (
+	"compress/gzip"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/visonhuo/mykit/pkg/ipasn"
+)
+
+const ipToASN = "1.0.0.0\t1.0.0.255\t13335\tUS\tCLOUDFLARENET\n" +
+	"1.0.1.0\t1.0.3.255\t0\tNone\tNot routed\n" +
+	"1.0.4.0\t1.0.7.255\t38803\tAU\tWPL-AS-AP Wirefreebroadband Pty LTD\n" +
+	"10.0.0.1\t10.0.0.6\t64500\tZZ\tODD-RANGE\n" +
+	"2001:db8::\t2001:db8:ffff:ffff:ffff:ffff:ffff:ffff\t64501\tZZ\tDOC-V6\n"
+
+const pyASN = "; IP-ASN32-DAT file\n" +
+	"; Original source:\trib.20221101.0000.bz2\n" +
+	"8.0.0.0/8\t3356\n" +
+	"8.8.8.0/24\t15169\n" +
+	"2001:4860::/32\t15169\n"
+
+func TestLoadIPToASN(t *testing.T) {
+	table, err := ipasn.LoadIPToASN(strings.NewReader(ipToASN))
+	require.NoError(t, err)
+
+	as, ok := table.Lookup(net.ParseIP("1.0.0.1"))
+	require.True(t, ok)
+	require.Equal(t, ipasn.AS{Number: 13335, Name: "CLOUDFLARENET", Country: "US"}, as)
+	as, ok = table.Lookup(net.ParseIP("1.0.6.200"))
+	require.True(t, ok)
+	require.Equal(t, uint32(38803), as.Number)
+	_, ok = table.Lookup(net.ParseIP("1.0.2.1")) // not routed
+	require.False(t, ok)
+
+	// unaligned range is split into minimal prefixes
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.4", "10.0.0.6"} {
+		as, ok = table.Lookup(net.ParseIP(ip))
+		require.True(t, ok, ip)
+		require.Equal(t, uint32(64500), as.Number, ip)
+	}
+	for _, ip := range []string{"10.0.0.0", "10.0.0.7"} {
+		_, ok = table.Lookup(net.ParseIP(ip))
+		require.False(t, ok, ip)
+	}
+
+	number, name, ok := table.LookupASN(net.ParseIP("2001:db8::1"))
+	require.True(t, ok)
+	require.Equal(t, uint32(64501), number)
+	require.Equal(t, "DOC-V6", name)
+
+	_, err = ipasn.LoadIPToASN(strings.NewReader("1.0.0.0\t::1\t1\n"))
+	require.Error(t, err)
+}
+
+func TestLoadPyASN(t *testing.T) {
+	table, err := ipasn.LoadPyASN(strings.NewReader(pyASN))
+	require.NoError(t, err)
+	require.Equal(t, 3, table.Len())
+
+	// longest prefix wins
+	as, ok := table.Lookup(net.ParseIP("8.8.8.8"))
+	require.True(t, ok)
+	require.Equal(t, uint32(15169), as.Number)
+	as, ok = table.Lookup(net.ParseIP("8.8.4.4"))
+	require.True(t, ok)
+	require.Equal(t, uint32(3356), as.Number)
+	as, ok = table.Lookup(net.ParseIP("2001:4860:4860::8888"))
+	require.True(t, ok)
+	require.Equal(t, uint32(15169), as.Number)
+	_, ok = table.Lookup(net.ParseIP("9.9.9.9"))
+	require.False(t, ok)
+
+	// IPv4-mapped IPv6 prefix is inserted as IPv4 one
+	table, err = ipasn.LoadPyASN(strings.NewReader(pyASN + "::ffff:192.0.2.0/120\t64500\n"))
+	require.NoError(t, err)
+	require.Equal(t, 4, table.Len())
+	as, ok = table.Lookup(net.ParseIP("192.0.2.1"))
+	require.True(t, ok)
+	require.Equal(t, uint32(64500), as.Number)
+	_, ok = table.Lookup(net.ParseIP("192.0.3.1"))
+	require.False(t, ok)
+}
+
+func TestLoadFile(t *testing.T) {
+	dir := t.TempDir()
+	tsv := filepath.Join(dir, "ip2asn-combined.tsv.gz")
+	f, err := os.Create(tsv)
+	require.NoError(t, err)
+	gw := gzip.NewWriter(f)
+	_, err = gw.Write([]byte(ipToASN))
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+	require.NoError(t, f.Close())
+
+	dat := filepath.Join(dir, "ipasn.dat")
+	require.NoError(t, os.WriteFile(dat, []byte(pyASN), 0o644))
+
+	table, err := ipasn.LoadFile(tsv)
+	require.NoError(t, err)
+	as, ok := table.Lookup(net.ParseIP("1.0.0.1"))
+	require.True(t, ok)
+	require.Equal(t, "CLOUDFLARENET", as.Name)
+
+	table, err = ipasn.LoadFile(dat)
+	require.NoError(t, err)
+	as, ok = table.Lookup(net.ParseIP("8.8.8.8"))
+	require.True(t, ok)
+	require.Equal(t, uint32(15169), as.Number)
+}
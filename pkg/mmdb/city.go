@@ -0,0 +1,49 @@
+package mmdb
+
+import "net"
+
+// City is the geographical location of an address recorded by GeoIP2 or
+// GeoLite2 City database, only Country is available in Country database.
+type City struct {
+	Country   string // ISO 3166-1 country code
+	City      string // city name in English
+	Latitude  float64
+	Longitude float64
+	// HasLocation reports whether Latitude and Longitude are available.
+	HasLocation bool
+}
+
+// LookupCity returns the location of ip, it returns false if ip isn't found.
+func (r *Reader) LookupCity(ip net.IP) (City, bool, error) {
+	value, err := r.Lookup(ip)
+	if err != nil || value == nil {
+		return City{}, false, err
+	}
+	record, _ := value.(map[string]interface{})
+
+	var city City
+	city.Country, _ = field(record, "country", "iso_code").(string)
+	if city.Country == "" { // anonymous proxies or satellite providers
+		city.Country, _ = field(record, "registered_country", "iso_code").(string)
+	}
+	city.City, _ = field(record, "city", "names", "en").(string)
+	lat, latOK := field(record, "location", "latitude").(float64)
+	lon, lonOK := field(record, "location", "longitude").(float64)
+	if latOK && lonOK {
+		city.Latitude, city.Longitude, city.HasLocation = lat, lon, true
+	}
+	return city, true, nil
+}
+
+// field returns the value of nested maps by path of keys.
+func field(m map[string]interface{}, path ...string) interface{} {
+	var value interface{} = m
+	for _, key := range path {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = m[key]
+	}
+	return value
+}
@@ -0,0 +1,210 @@
+package mmdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+)
+
+// data field types of MaxMind DB format
+const (
+	typeExtended  = 0
+	typePointer   = 1
+	typeString    = 2
+	typeDouble    = 3
+	typeBytes     = 4
+	typeUint16    = 5
+	typeUint32    = 6
+	typeMap       = 7
+	typeInt32     = 8
+	typeUint64    = 9
+	typeUint128   = 10
+	typeArray     = 11
+	typeContainer = 12
+	typeEndMarker = 13
+	typeBool      = 14
+	typeFloat     = 15
+)
+
+// maxDecodeDepth limits the nesting of maps and arrays of corrupted data.
+const maxDecodeDepth = 64
+
+var errTruncated = errors.New("mmdb: truncated data")
+
+// decoder decodes the data section of MaxMind DB. Offsets are relative to the
+// start of data section, which pointers refer to.
+type decoder struct {
+	data []byte
+}
+
+// decode decodes the field at offset, it returns the value and the offset of
+// next field. Values are decoded as map[string]interface{}, []interface{},
+// string, []byte, float64, uint64, int64, *big.Int (uint128) and bool.
+func (d *decoder) decode(offset int) (interface{}, int, error) {
+	return d.decodeDepth(offset, 0)
+}
+
+func (d *decoder) decodeDepth(offset, depth int) (interface{}, int, error) {
+	if depth > maxDecodeDepth {
+		return nil, 0, errors.New("mmdb: data nested too deep")
+	}
+	typ, size, offset, err := d.control(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if typ == typePointer {
+		target, next, err := d.pointer(size, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		value, _, err := d.decodeDepth(target, depth+1)
+		return value, next, err
+	}
+	switch typ {
+	case typeMap:
+		m := make(map[string]interface{}, size)
+		for i := 0; i < size; i++ {
+			key, next, err := d.decodeDepth(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			k, ok := key.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("mmdb: invalid map key type %T", key)
+			}
+			value, next, err := d.decodeDepth(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[k] = value
+			offset = next
+		}
+		return m, offset, nil
+
+	case typeArray:
+		a := make([]interface{}, 0, size)
+		for i := 0; i < size; i++ {
+			value, next, err := d.decodeDepth(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+			offset = next
+		}
+		return a, offset, nil
+
+	case typeBool:
+		return size != 0, offset, nil
+	}
+
+	if offset+size > len(d.data) {
+		return nil, 0, errTruncated
+	}
+	b, next := d.data[offset:offset+size], offset+size
+	switch typ {
+	case typeString:
+		return string(b), next, nil
+	case typeBytes:
+		return append([]byte(nil), b...), next, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("mmdb: invalid double size %d", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), next, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("mmdb: invalid float size %d", size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), next, nil
+	case typeUint16, typeUint32, typeUint64:
+		if size > 8 {
+			return nil, 0, fmt.Errorf("mmdb: invalid uint size %d", size)
+		}
+		return uintValue(b), next, nil
+	case typeInt32:
+		if size > 4 {
+			return nil, 0, fmt.Errorf("mmdb: invalid int32 size %d", size)
+		}
+		return int64(int32(uintValue(b))), next, nil
+	case typeUint128:
+		if size > 16 {
+			return nil, 0, fmt.Errorf("mmdb: invalid uint128 size %d", size)
+		}
+		return new(big.Int).SetBytes(b), next, nil
+	default:
+		return nil, 0, fmt.Errorf("mmdb: unexpected data type %d", typ)
+	}
+}
+
+// control parses the control byte (and extended type and size bytes) of the
+// field at offset, it returns the offset of field payload.
+func (d *decoder) control(offset int) (typ, size, next int, err error) {
+	if offset >= len(d.data) {
+		return 0, 0, 0, errTruncated
+	}
+	ctrl := d.data[offset]
+	offset++
+	typ = int(ctrl >> 5)
+	if typ == typePointer {
+		return typ, int(ctrl & 0x1f), offset, nil
+	}
+	if typ == typeExtended {
+		if offset >= len(d.data) {
+			return 0, 0, 0, errTruncated
+		}
+		typ = 7 + int(d.data[offset])
+		offset++
+		if typ < typeInt32 || typ > typeFloat {
+			return 0, 0, 0, fmt.Errorf("mmdb: invalid extended type %d", typ)
+		}
+	}
+
+	size = int(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28 // number of size bytes
+		if offset+n > len(d.data) {
+			return 0, 0, 0, errTruncated
+		}
+		v := int(uintValue(d.data[offset : offset+n]))
+		offset += n
+		switch n {
+		case 1:
+			size = 29 + v
+		case 2:
+			size = 285 + v
+		default:
+			size = 65821 + v
+		}
+	}
+	return typ, size, offset, nil
+}
+
+// pointer decodes the pointer whose control bits are ctrl, it returns the
+// pointed offset and the offset after pointer.
+func (d *decoder) pointer(ctrl, offset int) (int, int, error) {
+	n := (ctrl>>3)&0x3 + 1 // number of pointer bytes
+	if offset+n > len(d.data) {
+		return 0, 0, errTruncated
+	}
+	v := int(uintValue(d.data[offset : offset+n]))
+	switch n {
+	case 1:
+		v = (ctrl&0x7)<<8 | v
+	case 2:
+		v = ((ctrl&0x7)<<16 | v) + 2048
+	case 3:
+		v = ((ctrl&0x7)<<24 | v) + 526336
+	}
+	return v, offset + n, nil
+}
+
+func uintValue(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
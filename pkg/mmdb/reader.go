@@ -0,0 +1,198 @@
+// Package mmdb reads MaxMind DB (MMDB) files, such as GeoLite2 City, from
+// local file without any network access.
+//
+// See https://maxmind.github.io/MaxMind-DB/ for the format specification.
+package mmdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+const (
+	// metadataMaxSize is the maximum size of metadata section at file end.
+	metadataMaxSize = 128 * 1024
+	// dataSeparatorSize is the size of zero bytes between search tree and
+	// data section.
+	dataSeparatorSize = 16
+)
+
+// Metadata describes the database.
+type Metadata struct {
+	BinaryFormatMajorVersion uint
+	BinaryFormatMinorVersion uint
+	BuildEpoch               uint64
+	DatabaseType             string
+	Description              map[string]string
+	IPVersion                uint
+	Languages                []string
+	NodeCount                uint
+	RecordSize               uint
+}
+
+// Reader looks up the data records of IP addresses in a MaxMind DB, which is
+// loaded into memory entirely. Reader is safe for concurrent use.
+type Reader struct {
+	Metadata Metadata
+
+	tree      []byte
+	decoder   decoder
+	ipv4Start uint // search tree node of ::/96 in IPv6 database
+}
+
+// Open reads the database file of path.
+func Open(path string) (*Reader, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return FromBytes(b)
+}
+
+// FromBytes returns a reader of database b.
+func FromBytes(b []byte) (*Reader, error) {
+	start := len(b) - metadataMaxSize
+	if start < 0 {
+		start = 0
+	}
+	i := bytes.LastIndex(b[start:], metadataMarker)
+	if i < 0 {
+		return nil, errors.New("mmdb: metadata section not found")
+	}
+	metaStart := start + i + len(metadataMarker)
+	metaDecoder := decoder{data: b[metaStart:]}
+	value, _, err := metaDecoder.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("mmdb: decode metadata: %w", err)
+	}
+	meta, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("mmdb: invalid metadata")
+	}
+
+	r := &Reader{Metadata: parseMetadata(meta)}
+	if r.Metadata.BinaryFormatMajorVersion != 2 {
+		return nil, fmt.Errorf("mmdb: unsupported format version %d", r.Metadata.BinaryFormatMajorVersion)
+	}
+	switch r.Metadata.RecordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("mmdb: unsupported record size %d", r.Metadata.RecordSize)
+	}
+	if r.Metadata.IPVersion != 4 && r.Metadata.IPVersion != 6 {
+		return nil, fmt.Errorf("mmdb: unsupported ip version %d", r.Metadata.IPVersion)
+	}
+	treeSize := int(r.Metadata.NodeCount * r.Metadata.RecordSize / 4)
+	if treeSize+dataSeparatorSize > start+i {
+		return nil, errors.New("mmdb: search tree exceeds file")
+	}
+	r.tree = b[:treeSize]
+	r.decoder = decoder{data: b[treeSize+dataSeparatorSize : start+i]}
+
+	if r.Metadata.IPVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < r.Metadata.NodeCount; i++ {
+			node = r.record(node, 0)
+		}
+		r.ipv4Start = node
+	}
+	return r, nil
+}
+
+// Lookup returns the data record of ip decoded as generic values, see
+// decoder.decode for types of values. It returns nil if ip isn't found.
+func (r *Reader) Lookup(ip net.IP) (interface{}, error) {
+	offset, ok, err := r.lookupOffset(ip)
+	if err != nil || !ok {
+		return nil, err
+	}
+	value, _, err := r.decoder.decode(offset)
+	return value, err
+}
+
+func (r *Reader) lookupOffset(ip net.IP) (int, bool, error) {
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		if r.Metadata.IPVersion == 6 {
+			node = r.ipv4Start
+		}
+	} else if ip = ip.To16(); ip == nil {
+		return 0, false, errors.New("mmdb: invalid ip address")
+	} else if r.Metadata.IPVersion == 4 {
+		return 0, false, errors.New("mmdb: ipv6 address lookup in ipv4 database")
+	}
+
+	count := r.Metadata.NodeCount
+	for i := 0; i < len(ip)*8 && node < count; i++ {
+		bit := uint(ip[i/8]>>(7-uint(i%8))) & 1
+		node = r.record(node, bit)
+	}
+	switch {
+	case node == count: // empty record
+		return 0, false, nil
+	case node > count:
+		offset := int(node - count - dataSeparatorSize)
+		if offset < 0 || offset >= len(r.decoder.data) {
+			return 0, false, errors.New("mmdb: invalid data pointer in search tree")
+		}
+		return offset, true, nil
+	default:
+		return 0, false, errors.New("mmdb: invalid search tree")
+	}
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node.
+func (r *Reader) record(node, bit uint) uint {
+	size := r.Metadata.RecordSize
+	b := r.tree[node*size/4:]
+	switch size {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		b = b[bit*4:]
+		return uint(b[0])<<24 | uint(b[1])<<16 | uint(b[2])<<8 | uint(b[3])
+	}
+}
+
+func parseMetadata(m map[string]interface{}) Metadata {
+	meta := Metadata{
+		BinaryFormatMajorVersion: uint(toUint(m["binary_format_major_version"])),
+		BinaryFormatMinorVersion: uint(toUint(m["binary_format_minor_version"])),
+		BuildEpoch:               toUint(m["build_epoch"]),
+		IPVersion:                uint(toUint(m["ip_version"])),
+		NodeCount:                uint(toUint(m["node_count"])),
+		RecordSize:               uint(toUint(m["record_size"])),
+	}
+	meta.DatabaseType, _ = m["database_type"].(string)
+	if langs, ok := m["languages"].([]interface{}); ok {
+		for _, lang := range langs {
+			if s, ok := lang.(string); ok {
+				meta.Languages = append(meta.Languages, s)
+			}
+		}
+	}
+	if desc, ok := m["description"].(map[string]interface{}); ok {
+		meta.Description = make(map[string]string, len(desc))
+		for k, v := range desc {
+			meta.Description[k], _ = v.(string)
+		}
+	}
+	return meta
+}
+
+func toUint(v interface{}) uint64 {
+	u, _ := v.(uint64)
+	return u
+}
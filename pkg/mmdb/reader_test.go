@@ -0,0 +1,235 @@
+package mmdb_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/visonhuo/mykit/pkg/mmdb"
+)
+
+// pointer is a data field pointing to offset of data section.
+type pointer int
+
+func encodeControl(typ, size int) []byte {
+	var b []byte
+	var ext []byte
+	if typ > 7 {
+		ext = []byte{byte(typ - 7)}
+		typ = 0
+	}
+	switch {
+	case size < 29:
+		b = []byte{byte(typ<<5 | size)}
+	case size < 285:
+		b = []byte{byte(typ<<5 | 29), byte(size - 29)}
+	default:
+		b = []byte{byte(typ<<5 | 30), byte((size - 285) >> 8), byte(size - 285)}
+	}
+	// extended type byte follows control byte, size bytes follow both
+	return append(append(b[:1:1], ext...), b[1:]...)
+}
+
+func encode(v interface{}) []byte {
+	switch v := v.(type) {
+	case pointer:
+		return []byte{byte(1<<5 | (int(v)>>8)&0x7), byte(v)}
+	case string:
+		return append(encodeControl(2, len(v)), v...)
+	case float64:
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, math.Float64bits(v))
+		return append(encodeControl(3, 8), b...)
+	case uint64:
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, v)
+		b = bytes.TrimLeft(b, "\x00")
+		return append(encodeControl(9, len(b)), b...)
+	case bool:
+		if v {
+			return encodeControl(14, 1)
+		}
+		return encodeControl(14, 0)
+	case []interface{}:
+		b := encodeControl(11, len(v))
+		for _, item := range v {
+			b = append(b, encode(item)...)
+		}
+		return b
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		b := encodeControl(7, len(v))
+		for _, key := range keys {
+			b = append(b, encode(key)...)
+			b = append(b, encode(v[key])...)
+		}
+		return b
+	}
+	panic("unsupported type")
+}
+
+type testNode [2]int // child node index, or -1-offset of data, or 0 (empty)
+
+// buildDB builds an IPv6 database of records by CIDR, and data section
+// starts with the raw bytes of prefix.
+func buildDB(t *testing.T, recordSize int, prefix []byte, records map[string]interface{}) []byte {
+	data := append([]byte(nil), prefix...)
+	nodes := []testNode{{}}
+	for cidr, record := range records {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		require.NoError(t, err)
+		ones, bits := ipNet.Mask.Size()
+		ip := ipNet.IP.To16()
+		if bits == 32 { // IPv4 subtree is ::/96
+			ones += 96
+		}
+
+		offset := len(data)
+		data = append(data, encode(record)...)
+		node := 0
+		for i := 0; i < ones; i++ {
+			bit := int(ip[i/8]>>(7-uint(i%8))) & 1
+			if bits == 32 && i < 96 {
+				bit = 0
+			}
+			if i == ones-1 {
+				nodes[node][bit] = -1 - offset
+				break
+			}
+			if nodes[node][bit] <= 0 {
+				nodes = append(nodes, testNode{})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+	}
+
+	count := len(nodes)
+	var tree []byte
+	for _, node := range nodes {
+		var values [2]uint32
+		for i, child := range node {
+			switch {
+			case child > 0:
+				values[i] = uint32(child)
+			case child < 0:
+				values[i] = uint32(count + 16 + (-1 - child))
+			default:
+				values[i] = uint32(count)
+			}
+		}
+		switch recordSize {
+		case 24:
+			tree = append(tree, byte(values[0]>>16), byte(values[0]>>8), byte(values[0]),
+				byte(values[1]>>16), byte(values[1]>>8), byte(values[1]))
+		case 28:
+			tree = append(tree, byte(values[0]>>16), byte(values[0]>>8), byte(values[0]),
+				byte(values[0]>>24)<<4|byte(values[1]>>24),
+				byte(values[1]>>16), byte(values[1]>>8), byte(values[1]))
+		default:
+			b := make([]byte, 8)
+			binary.BigEndian.PutUint32(b[:4], values[0])
+			binary.BigEndian.PutUint32(b[4:], values[1])
+			tree = append(tree, b...)
+		}
+	}
+
+	b := append(tree, make([]byte, 16)...)
+	b = append(b, data...)
+	b = append(b, "\xab\xcd\xefMaxMind.com"...)
+	return append(b, encode(map[string]interface{}{
+		"binary_format_major_version": uint64(2),
+		"binary_format_minor_version": uint64(0),
+		"build_epoch":                 uint64(1666000000),
+		"database_type":               "Test-City",
+		"description":                 map[string]interface{}{"en": "test database"},
+		"ip_version":                  uint64(6),
+		"languages":                   []interface{}{"en"},
+		"node_count":                  uint64(count),
+		"record_size":                 uint64(recordSize),
+	})...)
+}
+
+func testRecords() ([]byte, map[string]interface{}) {
+	prefix := encode("JP") // shared by pointer
+	return prefix, map[string]interface{}{
+		"192.0.2.0/24": map[string]interface{}{
+			"country":  map[string]interface{}{"iso_code": "US"},
+			"city":     map[string]interface{}{"names": map[string]interface{}{"en": "Los Angeles"}},
+			"location": map[string]interface{}{"latitude": 34.0544, "longitude": -118.2441},
+		},
+		"198.51.100.0/25": map[string]interface{}{
+			"country": map[string]interface{}{"iso_code": pointer(0)},
+			"city":    map[string]interface{}{"names": map[string]interface{}{"en": "Tokyo"}},
+		},
+		"2001:db8::/32": map[string]interface{}{
+			"registered_country": map[string]interface{}{"iso_code": "DE"},
+			"anonymous":          true,
+		},
+	}
+}
+
+func TestReader(t *testing.T) {
+	prefix, records := testRecords()
+	for _, recordSize := range []int{24, 28, 32} {
+		r, err := mmdb.FromBytes(buildDB(t, recordSize, prefix, records))
+		require.NoError(t, err, recordSize)
+		require.Equal(t, "Test-City", r.Metadata.DatabaseType)
+		require.Equal(t, uint(6), r.Metadata.IPVersion)
+		require.Equal(t, []string{"en"}, r.Metadata.Languages)
+		require.Equal(t, "test database", r.Metadata.Description["en"])
+
+		city, ok, err := r.LookupCity(net.ParseIP("192.0.2.77"))
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, mmdb.City{
+			Country: "US", City: "Los Angeles", Latitude: 34.0544, Longitude: -118.2441, HasLocation: true,
+		}, city)
+
+		city, ok, err = r.LookupCity(net.ParseIP("198.51.100.127"))
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, mmdb.City{Country: "JP", City: "Tokyo"}, city)
+		_, ok, err = r.LookupCity(net.ParseIP("198.51.100.128"))
+		require.NoError(t, err)
+		require.False(t, ok)
+
+		city, ok, err = r.LookupCity(net.ParseIP("2001:db8::1"))
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, "DE", city.Country)
+		value, err := r.Lookup(net.ParseIP("2001:db8::1"))
+		require.NoError(t, err)
+		require.Equal(t, true, value.(map[string]interface{})["anonymous"])
+
+		value, err = r.Lookup(net.ParseIP("2001:db9::1"))
+		require.NoError(t, err)
+		require.Nil(t, value)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	prefix, records := testRecords()
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	require.NoError(t, os.WriteFile(path, buildDB(t, 28, prefix, records), 0o644))
+
+	r, err := mmdb.Open(path)
+	require.NoError(t, err)
+	city, ok, err := r.LookupCity(net.ParseIP("192.0.2.1"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "US", city.Country)
+
+	_, err = mmdb.FromBytes([]byte("not a database"))
+	require.Error(t, err)
+}
@@ -0,0 +1,302 @@
+package traceroute
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// AtlasResult is a traceroute result in the schema of RIPE Atlas, see
+// https://atlas.ripe.net/docs/apis/result-format/#version-4750.
+type AtlasResult struct {
+	Af        int        `json:"af"`
+	DstAddr   string     `json:"dst_addr"`
+	DstName   string     `json:"dst_name,omitempty"`
+	SrcAddr   string     `json:"src_addr,omitempty"`
+	From      string     `json:"from,omitempty"`
+	Proto     string     `json:"proto"`
+	Size      int        `json:"size"`
+	ParisID   int        `json:"paris_id"`
+	Timestamp int64      `json:"timestamp,omitempty"`
+	EndTime   int64      `json:"endtime,omitempty"`
+	MsmID     int        `json:"msm_id,omitempty"`
+	PrbID     int        `json:"prb_id,omitempty"`
+	Type      string     `json:"type"`
+	Result    []AtlasHop `json:"result"`
+}
+
+// AtlasHop is the result of a hop in AtlasResult, Error is set if probes
+// couldn't be sent.
+type AtlasHop struct {
+	Hop    int          `json:"hop"`
+	Error  string       `json:"error,omitempty"`
+	Result []AtlasReply `json:"result,omitempty"`
+}
+
+// AtlasReply is the reply to a probe in AtlasHop, X is "*" for timeout.
+type AtlasReply struct {
+	X       string        `json:"x,omitempty"`
+	From    string        `json:"from,omitempty"`
+	RTT     float64       `json:"rtt,omitempty"`
+	Size    int           `json:"size,omitempty"`
+	TTL     int           `json:"ttl,omitempty"`
+	Err     interface{}   `json:"err,omitempty"`  // letter of ICMP error, or unreachable code
+	ITTL    int           `json:"ittl,omitempty"` // quoted TTL, if it isn't 1
+	MTU     int           `json:"mtu,omitempty"`
+	ICMPExt *AtlasICMPExt `json:"icmpext,omitempty"`
+}
+
+// AtlasICMPExt is the ICMP extensions of AtlasReply.
+type AtlasICMPExt struct {
+	Version int               `json:"version"`
+	RFC4884 int               `json:"rfc4884"`
+	Obj     []AtlasICMPExtObj `json:"obj"`
+}
+
+// AtlasICMPExtObj is an ICMP extension object, only MPLS label stack is
+// decoded.
+type AtlasICMPExtObj struct {
+	Class int         `json:"class"`
+	Type  int         `json:"type"`
+	MPLS  []AtlasMPLS `json:"mpls,omitempty"`
+}
+
+// AtlasMPLS is an entry of MPLS label stack.
+type AtlasMPLS struct {
+	Label int `json:"label"`
+	Exp   int `json:"exp"`
+	S     int `json:"s"`
+	TTL   int `json:"ttl"`
+}
+
+// atlasErrors are the ICMP destination unreachable codes of Atlas error
+// letters, in ICMPv4 and ICMPv6.
+var atlasErrors = map[string][2]int{
+	"N": {0, 0},  // network unreachable, no route
+	"H": {1, 3},  // host unreachable, address unreachable
+	"A": {13, 1}, // administratively prohibited
+	"P": {2, -1}, // protocol unreachable
+	"p": {3, 4},  // port unreachable
+	"h": {-1, 2}, // beyond scope of source address
+}
+
+// MarshalAtlas encodes r in RIPE Atlas traceroute result schema.
+func MarshalAtlas(r Result) ([]byte, error) {
+	return json.Marshal(NewAtlasResult(r))
+}
+
+// UnmarshalAtlas decodes a RIPE Atlas traceroute result.
+func UnmarshalAtlas(b []byte) (Result, error) {
+	var a AtlasResult
+	if err := json.Unmarshal(b, &a); err != nil {
+		return Result{}, err
+	}
+	return a.ToResult()
+}
+
+// NewAtlasResult converts r into RIPE Atlas schema. Every attempt is a reply
+// of hop in sending order, and the attempts failed to send are summarized by
+// the error of hop. Interface information extensions are dropped, since Atlas
+// doesn't decode them.
+func NewAtlasResult(r Result) AtlasResult {
+	a := AtlasResult{
+		Af:      4,
+		DstAddr: ipString(r.DstIP),
+		Proto:   strings.ToUpper(string(r.Opts.Protocol)),
+		Size:    r.Opts.PacketSize,
+		Type:    "traceroute",
+		Result:  []AtlasHop{},
+	}
+	if r.DstIP != nil && r.DstIP.To4() == nil {
+		a.Af = 6
+	}
+	if a.Proto == "" {
+		a.Proto = strings.ToUpper(string(ProtocolUDP))
+	}
+	if r.Opts.Paris {
+		a.ParisID = 1
+	}
+	for _, hop := range r.Hops {
+		h := AtlasHop{Hop: hop.TTL}
+		for _, attempt := range hop.Attempts {
+			switch attempt.Outcome {
+			case OutcomeError:
+				if h.Error == "" && attempt.Err != nil {
+					h.Error = attempt.Err.Error()
+				}
+			case OutcomeTimeout:
+				h.Result = append(h.Result, AtlasReply{X: "*"})
+			default:
+				h.Result = append(h.Result, newAtlasReply(attempt, r.DstIP))
+			}
+		}
+		a.Result = append(a.Result, h)
+	}
+	return a
+}
+
+func newAtlasReply(attempt Attempt, dst net.IP) AtlasReply {
+	reply := AtlasReply{
+		From: ipString(attempt.From),
+		RTT:  math.Round(toMillis(attempt.RTT)*1000) / 1000,
+		TTL:  attempt.ReplyTTL,
+	}
+	if attempt.QuotedTTL > 1 {
+		reply.ITTL = attempt.QuotedTTL
+	}
+	if attempt.Outcome == OutcomeTooBig {
+		reply.MTU = attempt.MTU
+	} else if unreachable(attempt) {
+		v6 := attempt.From.To4() == nil
+		reply.Err = attempt.ICMPCode
+		for letter, codes := range atlasErrors {
+			if !v6 && codes[0] == attempt.ICMPCode || v6 && codes[1] == attempt.ICMPCode {
+				reply.Err = letter
+			}
+		}
+		if reply.Err == "p" && attempt.From.Equal(dst) {
+			reply.Err = nil // port unreachable of destination isn't an error
+		}
+	}
+	if len(attempt.MPLSLabels) > 0 {
+		obj := AtlasICMPExtObj{Class: 1, Type: 1}
+		for _, l := range attempt.MPLSLabels {
+			entry := AtlasMPLS{Label: l.Label, Exp: l.TC, TTL: l.TTL}
+			if l.S {
+				entry.S = 1
+			}
+			obj.MPLS = append(obj.MPLS, entry)
+		}
+		reply.ICMPExt = &AtlasICMPExt{Version: 2, RFC4884: 1, Obj: []AtlasICMPExtObj{obj}}
+	}
+	return reply
+}
+
+// ToResult converts a into Result. ICMP type and code of replies without
+// error are inferred by protocol: Time Exceeded for routers, and Port
+// Unreachable or Echo Reply for destination.
+func (a AtlasResult) ToResult() (Result, error) {
+	r := Result{DstIP: net.ParseIP(a.DstAddr)}
+	if r.DstIP == nil {
+		return Result{}, errors.New("invalid dst_addr: " + a.DstAddr)
+	}
+	r.Opts.Protocol = Protocol(strings.ToLower(a.Proto))
+	r.Opts.PacketSize = a.Size
+	r.Opts.Paris = a.ParisID != 0
+	for _, h := range a.Result {
+		r.hop(h.Hop)
+		if h.Error != "" {
+			r.attempt(h.Hop, errors.New(h.Error))
+		}
+		for _, reply := range h.Result {
+			if reply.X == "*" || reply.From == "" {
+				r.attempt(h.Hop, nil)
+				continue
+			}
+			attempt, err := r.atlasAttempt(reply)
+			if err != nil {
+				return Result{}, err
+			}
+			i := r.attempt(h.Hop, nil)
+			if attempt.Outcome == OutcomeTooBig {
+				r.tooBig(h.Hop, i, attempt)
+			} else {
+				r.aggregate(h.Hop, i, attempt)
+			}
+		}
+		if h.Hop > r.Opts.MaxHop {
+			r.Opts.MaxHop = h.Hop
+		}
+	}
+	return r, nil
+}
+
+func (r *Result) atlasAttempt(reply AtlasReply) (Attempt, error) {
+	attempt := Attempt{
+		Outcome:   OutcomeReply,
+		From:      net.ParseIP(reply.From),
+		RTT:       fromMillis(reply.RTT),
+		ReplyTTL:  reply.TTL,
+		QuotedTTL: reply.ITTL,
+	}
+	if attempt.From == nil {
+		return Attempt{}, errors.New("invalid reply from: " + reply.From)
+	}
+	v6 := attempt.From.To4() == nil
+	switch {
+	case reply.MTU > 0:
+		attempt.Outcome, attempt.MTU = OutcomeTooBig, reply.MTU
+		attempt.ICMPType, attempt.ICMPCode = 3, 4
+		if v6 {
+			attempt.ICMPType, attempt.ICMPCode = 2, 0
+		}
+	case reply.Err != nil:
+		attempt.ICMPType = 3
+		if v6 {
+			attempt.ICMPType = 1
+		}
+		switch e := reply.Err.(type) {
+		case string:
+			codes, ok := atlasErrors[e]
+			if !ok {
+				code, err := strconv.Atoi(e)
+				if err != nil {
+					return Attempt{}, errors.New("invalid reply err: " + e)
+				}
+				codes = [2]int{code, code}
+			}
+			attempt.ICMPCode = codes[0]
+			if v6 {
+				attempt.ICMPCode = codes[1]
+			}
+		case float64:
+			attempt.ICMPCode = int(e)
+		}
+	case !attempt.From.Equal(r.DstIP):
+		attempt.ICMPType = 11 // time exceeded
+		if v6 {
+			attempt.ICMPType = 3
+		}
+	case r.Opts.Protocol == ProtocolICMP:
+		attempt.ICMPType = 0 // echo reply
+		if v6 {
+			attempt.ICMPType = 129
+		}
+	case r.Opts.Protocol == ProtocolUDP:
+		attempt.ICMPType, attempt.ICMPCode = 3, 3 // port unreachable
+		if v6 {
+			attempt.ICMPType, attempt.ICMPCode = 1, 4
+		}
+	}
+	// ICMP errors quote the probe, of which TTL is omitted if it's 1
+	if attempt.QuotedTTL == 0 && attempt.ICMPType != 0 && attempt.ICMPType != 129 {
+		attempt.QuotedTTL = 1
+	}
+	if reply.ICMPExt != nil {
+		for _, obj := range reply.ICMPExt.Obj {
+			for _, entry := range obj.MPLS {
+				attempt.MPLSLabels = append(attempt.MPLSLabels,
+					MPLSLabel{Label: entry.Label, TC: entry.Exp, S: entry.S != 0, TTL: entry.TTL})
+			}
+		}
+	}
+	return attempt, nil
+}
+
+// unreachable reports whether attempt is replied ICMP destination unreachable.
+func unreachable(attempt Attempt) bool {
+	if attempt.From.To4() == nil {
+		return attempt.ICMPType == 1
+	}
+	return attempt.ICMPType == 3
+}
+
+func ipString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
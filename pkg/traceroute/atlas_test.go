@@ -0,0 +1,101 @@
+package traceroute_test
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/visonhuo/mykit/pkg/traceroute"
+	"github.com/visonhuo/mykit/pkg/traceroute/traceroutetest"
+)
+
+func TestAtlas_RoundTrip(t *testing.T) {
+	for _, opts := range []traceroute.Options{
+		{Protocol: traceroute.ProtocolUDP},
+		{Protocol: traceroute.ProtocolICMP, Paris: true},
+	} {
+		network := traceroutetest.NewNetwork(simSrc, 1)
+		network.AddRouter("10.0.0.1")
+		network.AddRouter("10.0.1.1")
+		network.AddRouter("10.0.2.1").Silent = true
+		network.AddRouter("10.0.3.1")
+		network.AddHost(simDst)
+		network.Chain(time.Millisecond, simSrc, "10.0.0.1", "10.0.1.1", "10.0.2.1", "10.0.3.1", simDst)
+
+		opts.MaxHop, opts.Timeout = 5, 50*time.Millisecond
+		result := simulate(t, network, opts)
+		require.True(t, result.Reach)
+		b, err := traceroute.MarshalAtlas(result)
+		require.NoError(t, err)
+		decoded, err := traceroute.UnmarshalAtlas(b)
+		require.NoError(t, err)
+
+		require.Len(t, decoded.Hops, len(result.Hops))
+		// Atlas keeps RTT in microseconds, and only a few options. RTTs of
+		// node are decoded in sending order rather than receiving order.
+		for i := range result.Hops {
+			hop := &result.Hops[i]
+			for j := range hop.Nodes {
+				for k, rtt := range hop.Nodes[j].RTTs {
+					hop.Nodes[j].RTTs[k] = rtt.Round(time.Microsecond)
+				}
+				sortRTTs(hop.Nodes[j].RTTs)
+				sortRTTs(decoded.Hops[i].Nodes[j].RTTs)
+			}
+			for j := range hop.Attempts {
+				hop.Attempts[j].RTT = hop.Attempts[j].RTT.Round(time.Microsecond)
+			}
+		}
+		require.Equal(t, opts.Protocol, decoded.Opts.Protocol)
+		require.Equal(t, opts.Paris, decoded.Opts.Paris)
+		require.Equal(t, result.DstIP, decoded.DstIP)
+		require.Equal(t, result.Reach, decoded.Reach)
+		require.Equal(t, result.Hops, decoded.Hops)
+	}
+}
+
+func TestUnmarshalAtlas(t *testing.T) {
+	result, err := traceroute.UnmarshalAtlas([]byte(`{
+		"af": 4, "dst_addr": "198.51.100.1", "dst_name": "example.net", "from": "203.0.113.9",
+		"msm_id": 5001, "prb_id": 6001, "proto": "ICMP", "size": 48, "paris_id": 1,
+		"timestamp": 1666000000, "type": "traceroute",
+		"result": [
+			{"hop": 1, "result": [{"from": "192.0.2.1", "rtt": 1.234, "size": 76, "ttl": 255},
+				{"x": "*"},
+				{"from": "192.0.2.1", "rtt": 1.5, "size": 76, "ttl": 255}]},
+			{"hop": 2, "result": [{"from": "192.0.2.9", "rtt": 5.1, "size": 140, "ttl": 253, "ittl": 2,
+				"icmpext": {"version": 2, "rfc4884": 1, "obj": [{"class": 1, "type": 1,
+					"mpls": [{"exp": 0, "label": 16005, "s": 1, "ttl": 1}]}]}}]},
+			{"hop": 3, "result": [{"from": "192.0.2.17", "rtt": 9.8, "size": 28, "ttl": 60, "err": "A"}]},
+			{"hop": 4, "result": [{"from": "198.51.100.1", "rtt": 12.001, "size": 48, "ttl": 57}]}
+		]}`))
+	require.NoError(t, err)
+	require.True(t, result.Reach)
+	require.Equal(t, traceroute.ProtocolICMP, result.Opts.Protocol)
+	require.True(t, result.Opts.Paris)
+	require.Len(t, result.Hops, 4)
+
+	hop := result.Hops[0]
+	require.Equal(t, 3, hop.Sent)
+	require.Equal(t, 2, hop.Received)
+	require.Equal(t, []time.Duration{1234 * time.Microsecond, 1500 * time.Microsecond}, hop.Nodes[0].RTTs)
+	require.Equal(t, traceroute.OutcomeTimeout, hop.Attempts[1].Outcome)
+	require.Equal(t, 255, hop.Attempts[0].ReplyTTL)
+	require.Equal(t, 11, hop.Attempts[0].ICMPType)
+
+	attempt := result.Hops[1].Attempts[0]
+	require.Equal(t, 2, attempt.QuotedTTL)
+	require.Equal(t, []traceroute.MPLSLabel{{Label: 16005, S: true, TTL: 1}}, attempt.MPLSLabels)
+
+	require.Equal(t, "!X", result.Hops[2].Attempts[0].Annotation())
+	require.Equal(t, 0, result.Hops[3].Attempts[0].ICMPType) // echo reply
+	require.Equal(t, 12001*time.Microsecond, result.Hops[3].Attempts[0].RTT)
+
+	_, err = traceroute.UnmarshalAtlas([]byte(`{"dst_addr": "example.net"}`))
+	require.Error(t, err)
+}
+
+func sortRTTs(rtts []time.Duration) {
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+}
@@ -7,26 +7,59 @@ import (
 	"time"
 )
 
+const (
+	NetworkIPv4 = "ip4"
+	NetworkIPv6 = "ip6"
+)
+
 type Config struct {
 	// errorLog specifies an optional logger for errors accepting
 	// connections, unexpected behavior from handlers, and
 	// underlying FileSystem errors.
 	// If nil, logging is done via the log package's standard logger.
-	ErrLogger       *log.Logger
+	ErrLogger *log.Logger
+	// Network specifies the address family used by the server,
+	// either NetworkIPv4 or NetworkIPv6. Default is NetworkIPv4.
+	Network         string
 	LocalSrcIP      net.IP
 	PacketQueueSize int
 	DispatchTimeout time.Duration
+	// Transport specifies how probe packets are sent and replies are
+	// received, it's closed by Server.Shutdown.
+	// If nil, raw sockets are used, see NewRawTransport.
+	Transport Transport
+	// Resolver looks up hostnames of hop addresses for the sessions with
+	// Options.LookupNames enabled. Default is net.DefaultResolver.
+	Resolver Resolver
+	// NameCacheTTL is how long the looked up hostnames are cached and shared
+	// by sessions, default is 10 minutes.
+	NameCacheTTL time.Duration
+	// MaxConcurrentLookups limits the number of concurrent hostname lookups
+	// of server, default is 8.
+	MaxConcurrentLookups int
 }
 
 func (c *Config) init() {
 	if c.ErrLogger == nil {
 		c.ErrLogger = log.New(os.Stderr, "", log.LstdFlags|log.Lshortfile)
 	}
+	if c.Network != NetworkIPv6 {
+		c.Network = NetworkIPv4
+	}
 	if c.LocalSrcIP == nil {
-		if localSrcIP, err := localIPv4(); err == nil {
-			c.LocalSrcIP = localSrcIP
-		} else {
-			c.LocalSrcIP = net.IPv4zero
+		switch c.Network {
+		case NetworkIPv6:
+			if localSrcIP, err := localIPv6(); err == nil {
+				c.LocalSrcIP = localSrcIP
+			} else {
+				c.LocalSrcIP = net.IPv6unspecified
+			}
+		default:
+			if localSrcIP, err := localIPv4(); err == nil {
+				c.LocalSrcIP = localSrcIP
+			} else {
+				c.LocalSrcIP = net.IPv4zero
+			}
 		}
 	}
 	if c.PacketQueueSize <= 0 {
@@ -35,4 +68,13 @@ func (c *Config) init() {
 	if c.DispatchTimeout <= 0 {
 		c.DispatchTimeout = 100 * time.Millisecond
 	}
+	if c.Resolver == nil {
+		c.Resolver = net.DefaultResolver
+	}
+	if c.NameCacheTTL <= 0 {
+		c.NameCacheTTL = defaultNameCacheTTL
+	}
+	if c.MaxConcurrentLookups <= 0 {
+		c.MaxConcurrentLookups = defaultMaxConcurrentLookups
+	}
 }
@@ -0,0 +1,239 @@
+package traceroute
+
+import (
+	"net"
+	"time"
+)
+
+// HopChange is the kind of difference of a hop between two results.
+type HopChange string
+
+const (
+	// HopAdded is the hop only on the new path, and HopRemoved is the one
+	// only on the old path.
+	HopAdded   HopChange = "added"
+	HopRemoved HopChange = "removed"
+	// HopChanged is the hop replied by different nodes on the two paths.
+	HopChanged HopChange = "changed"
+)
+
+// HopDiff is the difference of a hop between two results. OldTTL or NewTTL
+// is zero if the hop is absent from that path.
+type HopDiff struct {
+	Change HopChange
+	OldTTL int
+	NewTTL int
+	// OldIPs and NewIPs are the nodes replied to the hop on each path.
+	OldIPs []net.IP
+	NewIPs []net.IP
+}
+
+// RTTDelta is the RTT change of a node replied to the aligned hops of both
+// paths, RTTs are the average ones.
+type RTTDelta struct {
+	OldTTL int
+	NewTTL int
+	IP     net.IP
+	Old    time.Duration
+	New    time.Duration
+	Delta  time.Duration // New minus Old
+}
+
+// PathDiff is the difference between an old and a new result.
+type PathDiff struct {
+	Hops []HopDiff
+	// OldLength and NewLength are the length of paths, see Result.PathLength.
+	OldLength   int
+	NewLength   int
+	LengthDelta int
+	// RTTDeltas are the RTT changes beyond threshold in order of hops.
+	RTTDeltas []RTTDelta
+	OldReach  bool
+	NewReach  bool
+	// Unreachable reports whether destination is reached on the old path but
+	// not the new one.
+	Unreachable bool
+}
+
+// RouteChanged reports whether any hop is added, removed or changed.
+func (d PathDiff) RouteChanged() bool {
+	return len(d.Hops) > 0
+}
+
+// PathLength returns the length of path, that is the TTL of the first hop
+// destination replied, or the greatest TTL of hop replied if destination
+// isn't reached.
+func (r *Result) PathLength() int {
+	length := 0
+	for _, hop := range r.Hops {
+		for _, node := range hop.Nodes {
+			if r.Reach && node.IP.Equal(r.DstIP) {
+				return hop.TTL
+			}
+		}
+		if len(hop.Nodes) > 0 {
+			length = hop.TTL
+		}
+	}
+	return length
+}
+
+// Diff compares the path of result after with the one before. Hops are
+// aligned by IP first, that is the longest common sequence of hops sharing
+// nodes, so that a hop inserted or removed doesn't shift the following ones.
+// The hops between aligned ones are then paired by TTL order, the excess of
+// either side is added or removed. A pair of hops is changed if they are
+// replied by different nodes, silent hops are compared with nothing since the
+// route is unknown. The RTT deltas greater than threshold (in absolute value)
+// are reported for the nodes replied to paired hops on both paths.
+func Diff(before, after Result, threshold time.Duration) PathDiff {
+	d := PathDiff{
+		OldLength: before.PathLength(),
+		NewLength: after.PathLength(),
+		OldReach:  before.Reach,
+		NewReach:  after.Reach,
+	}
+	d.LengthDelta = d.NewLength - d.OldLength
+	d.Unreachable = before.Reach && !after.Reach
+
+	oldHops, newHops := pathHops(&before), pathHops(&after)
+	compare := func(o, n Hop) {
+		if len(o.Nodes) > 0 && len(n.Nodes) > 0 && !sameNodes(o, n) {
+			d.Hops = append(d.Hops, HopDiff{
+				Change: HopChanged,
+				OldTTL: o.TTL,
+				NewTTL: n.TTL,
+				OldIPs: nodeIPs(o),
+				NewIPs: nodeIPs(n),
+			})
+		}
+		d.RTTDeltas = append(d.RTTDeltas, rttDeltas(o, n, threshold)...)
+	}
+	// pair up the hops between aligned ones
+	i, j := 0, 0
+	gap := func(oldEnd, newEnd int) {
+		for ; i < oldEnd && j < newEnd; i, j = i+1, j+1 {
+			compare(oldHops[i], newHops[j])
+		}
+		for ; i < oldEnd; i++ {
+			d.Hops = append(d.Hops, HopDiff{Change: HopRemoved, OldTTL: oldHops[i].TTL, OldIPs: nodeIPs(oldHops[i])})
+		}
+		for ; j < newEnd; j++ {
+			d.Hops = append(d.Hops, HopDiff{Change: HopAdded, NewTTL: newHops[j].TTL, NewIPs: nodeIPs(newHops[j])})
+		}
+	}
+	for _, pair := range alignHops(oldHops, newHops) {
+		gap(pair[0], pair[1])
+		compare(oldHops[i], newHops[j])
+		i, j = i+1, j+1
+	}
+	gap(len(oldHops), len(newHops))
+	return d
+}
+
+// pathHops returns the hops of r up to the path length, trailing silent hops
+// (probed after destination stopped replying) are not part of path.
+func pathHops(r *Result) []Hop {
+	length := r.PathLength()
+	var hops []Hop
+	for _, hop := range r.Hops {
+		if hop.TTL <= length {
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// alignHops returns the index pairs of the longest common sequence of hops
+// sharing nodes.
+func alignHops(old, cur []Hop) [][2]int {
+	// lengths[i][j] is the LCS length of old[i:] and cur[j:]
+	lengths := make([][]int, len(old)+1)
+	for i := range lengths {
+		lengths[i] = make([]int, len(cur)+1)
+	}
+	for i := len(old) - 1; i >= 0; i-- {
+		for j := len(cur) - 1; j >= 0; j-- {
+			switch {
+			case shareNode(old[i], cur[j]):
+				lengths[i][j] = lengths[i+1][j+1] + 1
+			case lengths[i+1][j] >= lengths[i][j+1]:
+				lengths[i][j] = lengths[i+1][j]
+			default:
+				lengths[i][j] = lengths[i][j+1]
+			}
+		}
+	}
+
+	var pairs [][2]int
+	for i, j := 0, 0; i < len(old) && j < len(cur); {
+		switch {
+		case shareNode(old[i], cur[j]):
+			pairs = append(pairs, [2]int{i, j})
+			i, j = i+1, j+1
+		case lengths[i+1][j] >= lengths[i][j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+	return pairs
+}
+
+func shareNode(a, b Hop) bool {
+	for _, x := range a.Nodes {
+		for _, y := range b.Nodes {
+			if x.IP != nil && x.IP.Equal(y.IP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func sameNodes(a, b Hop) bool {
+	contains := func(hop Hop, ip net.IP) bool {
+		for _, node := range hop.Nodes {
+			if node.IP.Equal(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, node := range a.Nodes {
+		if !contains(b, node.IP) {
+			return false
+		}
+	}
+	for _, node := range b.Nodes {
+		if !contains(a, node.IP) {
+			return false
+		}
+	}
+	return true
+}
+
+func nodeIPs(hop Hop) []net.IP {
+	ips := make([]net.IP, 0, len(hop.Nodes))
+	for _, node := range hop.Nodes {
+		ips = append(ips, node.IP)
+	}
+	return ips
+}
+
+func rttDeltas(old, cur Hop, threshold time.Duration) []RTTDelta {
+	var deltas []RTTDelta
+	for _, o := range old.Nodes {
+		for _, n := range cur.Nodes {
+			if o.IP == nil || !o.IP.Equal(n.IP) || len(o.RTTs) == 0 || len(n.RTTs) == 0 {
+				continue
+			}
+			delta := RTTDelta{OldTTL: old.TTL, NewTTL: cur.TTL, IP: n.IP, Old: o.Stats().Avg, New: n.Stats().Avg}
+			delta.Delta = delta.New - delta.Old
+			if absDuration(delta.Delta) > threshold {
+				deltas = append(deltas, delta)
+			}
+		}
+	}
+	return deltas
+}
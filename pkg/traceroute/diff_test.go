@@ -0,0 +1,88 @@
+package traceroute_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/visonhuo/mykit/pkg/traceroute"
+)
+
+func parseTraceroute(t *testing.T, output string) traceroute.Result {
+	result, err := traceroute.ParseTraceroute(strings.NewReader(output))
+	require.NoError(t, err)
+	return result
+}
+
+func TestDiff(t *testing.T) {
+	before := parseTraceroute(t, `traceroute to 192.0.2.9 (192.0.2.9), 30 hops max
+ 1  10.0.0.1  1.000 ms  1.000 ms
+ 2  10.0.1.1  5.000 ms  5.000 ms
+ 3  * *
+ 4  10.0.3.1  8.000 ms  8.000 ms
+ 5  192.0.2.9  10.000 ms  10.000 ms
+`)
+	after := parseTraceroute(t, `traceroute to 192.0.2.9 (192.0.2.9), 30 hops max
+ 1  10.0.0.1  1.200 ms  1.200 ms
+ 2  10.0.9.1  6.000 ms  6.000 ms
+ 3  10.0.2.1  7.000 ms  7.000 ms
+ 4  10.0.2.2  7.500 ms  7.500 ms
+ 5  10.0.3.1  30.000 ms  30.000 ms
+ 6  192.0.2.9  32.000 ms  32.000 ms
+`)
+
+	d := traceroute.Diff(before, after, 5*time.Millisecond)
+	require.True(t, d.RouteChanged())
+	require.Equal(t, 5, d.OldLength)
+	require.Equal(t, 6, d.NewLength)
+	require.Equal(t, 1, d.LengthDelta)
+	require.True(t, d.OldReach)
+	require.True(t, d.NewReach)
+	require.False(t, d.Unreachable)
+
+	// 10.0.3.1 and destination are aligned by IP despite the shift of TTL,
+	// the silent hop 3 is paired with 10.0.2.1 and not reported.
+	require.Equal(t, []traceroute.HopDiff{
+		{Change: traceroute.HopChanged, OldTTL: 2, NewTTL: 2, OldIPs: ips("10.0.1.1"), NewIPs: ips("10.0.9.1")},
+		{Change: traceroute.HopAdded, NewTTL: 4, NewIPs: ips("10.0.2.2")},
+	}, d.Hops)
+	require.Equal(t, []traceroute.RTTDelta{
+		{OldTTL: 4, NewTTL: 5, IP: net.ParseIP("10.0.3.1"), Old: 8 * time.Millisecond, New: 30 * time.Millisecond, Delta: 22 * time.Millisecond},
+		{OldTTL: 5, NewTTL: 6, IP: net.ParseIP("192.0.2.9"), Old: 10 * time.Millisecond, New: 32 * time.Millisecond, Delta: 22 * time.Millisecond},
+	}, d.RTTDeltas)
+
+	d = traceroute.Diff(before, before, 0)
+	require.False(t, d.RouteChanged())
+	require.Empty(t, d.RTTDeltas)
+	require.Zero(t, d.LengthDelta)
+}
+
+func TestDiff_Unreachable(t *testing.T) {
+	before := parseTraceroute(t, `traceroute to 192.0.2.9 (192.0.2.9), 30 hops max
+ 1  10.0.0.1  1.000 ms
+ 2  10.0.1.1  2.000 ms
+ 3  192.0.2.9  3.000 ms
+`)
+	after := parseTraceroute(t, `traceroute to 192.0.2.9 (192.0.2.9), 30 hops max
+ 1  10.0.0.1  1.000 ms
+ 2  10.0.1.1  2.000 ms !H
+ 3  * * *
+`)
+	d := traceroute.Diff(before, after, time.Millisecond)
+	require.True(t, d.Unreachable)
+	require.Equal(t, -1, d.LengthDelta)
+	require.Equal(t, []traceroute.HopDiff{
+		{Change: traceroute.HopRemoved, OldTTL: 3, OldIPs: ips("192.0.2.9")},
+	}, d.Hops)
+	require.Empty(t, d.RTTDeltas)
+}
+
+func ips(s ...string) []net.IP {
+	var ips []net.IP
+	for _, ip := range s {
+		ips = append(ips, net.ParseIP(ip))
+	}
+	return ips
+}
@@ -0,0 +1,160 @@
+package traceroute
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultNameCacheTTL         = 10 * time.Minute
+	defaultMaxConcurrentLookups = 8
+)
+
+// Resolver looks up the names of address by reverse DNS (PTR record).
+// *net.Resolver implements it.
+type Resolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+type nameEntry struct {
+	name   string
+	expire time.Time
+}
+
+// nameLookup is a lookup in flight, done is closed once it finishes.
+type nameLookup struct {
+	done chan struct{}
+	name string
+	ok   bool // false if lookup is canceled
+}
+
+// nameCache caches the names of addresses until TTL, failed lookups are
+// cached as empty names as well, so that they aren't retried by every session.
+// Concurrent lookups of an address are deduplicated, by waiting for the one in
+// flight.
+type nameCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]nameEntry
+	pending map[string]*nameLookup
+}
+
+func newNameCache(ttl time.Duration) *nameCache {
+	return &nameCache{
+		ttl:     ttl,
+		entries: make(map[string]nameEntry),
+		pending: make(map[string]*nameLookup),
+	}
+}
+
+// get returns the cached name of addr, or the lookup in flight for addr if
+// it isn't cached. If none is in flight, a new lookup is returned with started
+// true, which must be finished by caller.
+func (c *nameCache) get(addr string) (string, *nameLookup, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.entries[addr]; ok {
+		if time.Now().Before(entry.expire) {
+			return entry.name, nil, false
+		}
+		delete(c.entries, addr)
+	}
+	if lookup, ok := c.pending[addr]; ok {
+		return "", lookup, false
+	}
+	lookup := &nameLookup{done: make(chan struct{})}
+	c.pending[addr] = lookup
+	return "", lookup, true
+}
+
+// finish records the result of lookup started for addr, the name is cached if
+// ok.
+func (c *nameCache) finish(addr string, lookup *nameLookup, name string, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ok {
+		c.entries[addr] = nameEntry{name: name, expire: time.Now().Add(c.ttl)}
+	}
+	delete(c.pending, addr)
+	lookup.name, lookup.ok = name, ok
+	close(lookup.done)
+}
+
+// lookupNames fills the hostname of every node in result. Lookups of distinct
+// addresses run concurrently, bounded by Config.MaxConcurrentLookups over all
+// sessions of server.
+func (s *Server) lookupNames(ctx context.Context, result *Result) {
+	var addrs []string
+	names := make(map[string]string)
+	for _, hop := range result.Hops {
+		for _, node := range hop.Nodes {
+			addr := node.IP.String()
+			if _, ok := names[addr]; !ok {
+				names[addr] = ""
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			name := s.lookupName(ctx, addr)
+			mu.Lock()
+			names[addr] = name
+			mu.Unlock()
+		}(addr)
+	}
+	wg.Wait()
+
+	result.eachNode(func(node *Node) {
+		node.Hostname = names[node.IP.String()]
+	})
+}
+
+func (s *Server) lookupName(ctx context.Context, addr string) string {
+	for {
+		name, lookup, started := s.names.get(addr)
+		if lookup == nil {
+			return name
+		}
+		if started {
+			name, ok := s.resolveName(ctx, addr)
+			s.names.finish(addr, lookup, name, ok)
+			return name
+		}
+		select {
+		case <-lookup.done:
+			if lookup.ok {
+				return lookup.name
+			}
+			// the session looking up is canceled, retry by this one
+		case <-ctx.Done():
+			return ""
+		}
+	}
+}
+
+// resolveName looks up the name of addr, ok is false if ctx is canceled.
+func (s *Server) resolveName(ctx context.Context, addr string) (string, bool) {
+	select {
+	case s.lookupSem <- struct{}{}:
+		defer func() { <-s.lookupSem }()
+	case <-ctx.Done():
+		return "", false
+	}
+	names, err := s.config.Resolver.LookupAddr(ctx, addr)
+	if err != nil && ctx.Err() != nil {
+		return "", false // canceled lookup isn't cached
+	}
+	var name string
+	if len(names) > 0 {
+		name = strings.TrimSuffix(names[0], ".")
+	}
+	return name, true
+}
@@ -0,0 +1,78 @@
+package traceroute
+
+import "net"
+
+// ASNLookup looks up the autonomous system of ip, *ipasn.Table implements it.
+type ASNLookup interface {
+	LookupASN(ip net.IP) (asn uint32, name string, ok bool)
+}
+
+// EnrichASN fills the AS number and name of every node in result by lookup.
+func (r *Result) EnrichASN(lookup ASNLookup) {
+	r.eachNode(func(node *Node) {
+		if asn, name, ok := lookup.LookupASN(node.IP); ok {
+			node.ASN, node.ASName = asn, name
+		}
+	})
+}
+
+// Location is the geographical location of an address, coordinates are zero
+// if unknown.
+type Location struct {
+	Country   string  `json:"country"` // ISO 3166-1 country code
+	City      string  `json:"city,omitempty"`
+	Latitude  float64 `json:"latitude,omitempty"`
+	Longitude float64 `json:"longitude,omitempty"`
+}
+
+// GeoLookup looks up the geographical location of ip.
+type GeoLookup interface {
+	LookupLocation(ip net.IP) (Location, bool)
+}
+
+// EnrichGeo fills the location of every node in result by lookup.
+func (r *Result) EnrichGeo(lookup GeoLookup) {
+	r.eachNode(func(node *Node) {
+		if location, ok := lookup.LookupLocation(node.IP); ok {
+			node.Location = &location
+		}
+	})
+}
+
+// ASSegment is a run of hops in the same autonomous system along the path.
+type ASSegment struct {
+	ASN      uint32
+	ASName   string
+	FirstTTL int
+	LastTTL  int
+}
+
+// ASPath returns the autonomous systems traversed by the path in order, so
+// every pair of adjacent segments is an AS transition. Hops with unknown AS
+// (silent or private addresses) don't break a segment. The AS of a hop is
+// the one of its first node with known AS, so it requires EnrichASN first.
+func (r *Result) ASPath() []ASSegment {
+	var path []ASSegment
+	for _, hop := range r.Hops {
+		for _, node := range hop.Nodes {
+			if node.ASN == 0 {
+				continue
+			}
+			if n := len(path); n > 0 && path[n-1].ASN == node.ASN {
+				path[n-1].LastTTL = hop.TTL
+			} else {
+				path = append(path, ASSegment{ASN: node.ASN, ASName: node.ASName, FirstTTL: hop.TTL, LastTTL: hop.TTL})
+			}
+			break
+		}
+	}
+	return path
+}
+
+func (r *Result) eachNode(fn func(node *Node)) {
+	for i := range r.Hops {
+		for j := range r.Hops[i].Nodes {
+			fn(&r.Hops[i].Nodes[j])
+		}
+	}
+}
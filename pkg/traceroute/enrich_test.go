@@ -0,0 +1,70 @@
+package traceroute_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/visonhuo/mykit/pkg/ipasn"
+	"github.com/visonhuo/mykit/pkg/traceroute"
+)
+
+func newResult(hops ...[]string) traceroute.Result {
+	var result traceroute.Result
+	for i, ips := range hops {
+		hop := traceroute.Hop{TTL: i + 1}
+		for _, ip := range ips {
+			hop.Nodes = append(hop.Nodes, traceroute.Node{IP: net.ParseIP(ip)})
+		}
+		result.Hops = append(result.Hops, hop)
+	}
+	return result
+}
+
+func TestResult_EnrichASN(t *testing.T) {
+	table, err := ipasn.LoadPyASN(strings.NewReader("" +
+		"192.0.2.0/24\t64500\n" +
+		"198.51.100.0/24\t64501\n" +
+		"203.0.113.0/24\t64502\n"))
+	require.NoError(t, err)
+
+	result := newResult(
+		[]string{"10.0.0.1"},
+		[]string{"192.0.2.1"},
+		nil, // silent hop
+		[]string{"192.0.2.9"},
+		[]string{"10.9.9.9", "198.51.100.1"},
+		[]string{"198.51.100.7"},
+		[]string{"203.0.113.1"},
+	)
+	result.EnrichASN(table)
+	require.Zero(t, result.Hops[0].Nodes[0].ASN)
+	require.Equal(t, uint32(64500), result.Hops[1].Nodes[0].ASN)
+	require.Equal(t, uint32(64501), result.Hops[4].Nodes[1].ASN)
+
+	require.Equal(t, []traceroute.ASSegment{
+		{ASN: 64500, FirstTTL: 2, LastTTL: 4},
+		{ASN: 64501, FirstTTL: 5, LastTTL: 6},
+		{ASN: 64502, FirstTTL: 7, LastTTL: 7},
+	}, result.ASPath())
+}
+
+type fakeGeoLookup map[string]traceroute.Location
+
+func (l fakeGeoLookup) LookupLocation(ip net.IP) (traceroute.Location, bool) {
+	location, ok := l[ip.String()]
+	return location, ok
+}
+
+func TestResult_EnrichGeo(t *testing.T) {
+	result := newResult([]string{"10.0.0.1"}, []string{"192.0.2.1", "198.51.100.1"})
+	result.EnrichGeo(fakeGeoLookup{
+		"192.0.2.1":    {Country: "US", City: "Los Angeles", Latitude: 34.0544, Longitude: -118.2441},
+		"198.51.100.1": {Country: "JP"},
+	})
+	require.Nil(t, result.Hops[0].Nodes[0].Location)
+	require.Equal(t, &traceroute.Location{Country: "US", City: "Los Angeles", Latitude: 34.0544, Longitude: -118.2441},
+		result.Hops[1].Nodes[0].Location)
+	require.Equal(t, "JP", result.Hops[1].Nodes[1].Location.Country)
+}
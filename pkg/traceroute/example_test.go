@@ -3,18 +3,33 @@ package traceroute_test
 import (
 	"context"
 	"fmt"
+	"net"
+	"sort"
+	"time"
 
 	"github.com/visonhuo/mykit/pkg/traceroute"
+	"github.com/visonhuo/mykit/pkg/traceroute/traceroutetest"
 )
 
 func ExampleServer() {
-	srv, err := traceroute.NewServer(traceroute.Config{})
+	// A virtual network stands in for the real one here, Server sends probes
+	// by raw sockets if Config.Transport is nil.
+	network := traceroutetest.NewNetwork("192.0.2.1", 1)
+	network.AddRouter("10.0.0.1")
+	network.AddRouter("10.0.1.1")
+	network.AddHost("198.51.100.1")
+	network.Chain(time.Millisecond, "192.0.2.1", "10.0.0.1", "10.0.1.1", "198.51.100.1")
+
+	srv, err := traceroute.NewServer(traceroute.Config{
+		LocalSrcIP: net.ParseIP("192.0.2.1"),
+		Transport:  network,
+	})
 	if err != nil {
 		panic(err)
 	}
+	defer srv.Shutdown()
 
-	host := "www.google.com"
-	future, err := srv.Traceroute(context.Background(), host, traceroute.Options{})
+	future, err := srv.Traceroute(context.Background(), "198.51.100.1", traceroute.Options{})
 	if err != nil {
 		panic(err)
 	}
@@ -22,8 +37,17 @@ func ExampleServer() {
 		panic(future.Error())
 	}
 	result := future.Result()
+	sort.Slice(result.Hops, func(i, j int) bool {
+		return result.Hops[i].TTL < result.Hops[j].TTL
+	})
 	fmt.Println(result.Reach)
+	for _, hop := range result.Hops {
+		fmt.Println(hop.TTL, hop.Nodes[0].IP)
+	}
 
 	// Output:
 	// true
+	// 1 10.0.0.1
+	// 2 10.0.1.1
+	// 3 198.51.100.1
 }
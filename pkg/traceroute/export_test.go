@@ -0,0 +1,11 @@
+package traceroute
+
+// MDAStoppingPoint exports mdaStoppingPoint for external tests.
+var MDAStoppingPoint = mdaStoppingPoint
+
+// Aggregate exports attempt and aggregate for external tests, it records a
+// probe sent to ttl, and returns the function recording the reply to it.
+func (r *Result) Aggregate(ttl int) func(reply Attempt) {
+	attempt := r.attempt(ttl, nil)
+	return func(reply Attempt) { r.aggregate(ttl, attempt, reply) }
+}
@@ -0,0 +1,70 @@
+package traceroute
+
+import (
+	"net"
+
+	"golang.org/x/net/icmp"
+)
+
+// MPLSLabel is an entry of the MPLS label stack extension (RFC 4950) of ICMP
+// reply, which tells the probe was forwarded through an MPLS tunnel.
+type MPLSLabel struct {
+	Label int  `json:"label"`
+	TC    int  `json:"tc"` // traffic class
+	S     bool `json:"s"`  // bottom of stack
+	TTL   int  `json:"ttl"`
+}
+
+// InterfaceRole is the role of interface identified by InterfaceInfo.
+type InterfaceRole string
+
+const (
+	InterfaceRoleIncoming InterfaceRole = "incoming"
+	InterfaceRoleSubIP    InterfaceRole = "sub-ip"
+	InterfaceRoleOutgoing InterfaceRole = "outgoing"
+	InterfaceRoleNextHop  InterfaceRole = "next-hop"
+)
+
+// InterfaceInfo is the interface information object extension (RFC 5837) of
+// ICMP reply, which identifies an interface of the replying router, such as
+// the one probe arrived on. Fields not included by router are zero.
+type InterfaceInfo struct {
+	Role    InterfaceRole `json:"role"`
+	IfIndex int           `json:"if_index,omitempty"`
+	Name    string        `json:"name,omitempty"`
+	MTU     int           `json:"mtu,omitempty"`
+	IP      net.IP        `json:"ip,omitempty"`
+}
+
+var interfaceRoles = [...]InterfaceRole{
+	InterfaceRoleIncoming,
+	InterfaceRoleSubIP,
+	InterfaceRoleOutgoing,
+	InterfaceRoleNextHop,
+}
+
+// parseExtensions converts the ICMP extensions parsed by icmp.ParseMessage,
+// the unknown extensions are ignored.
+func parseExtensions(exts []icmp.Extension) ([]MPLSLabel, []InterfaceInfo) {
+	var labels []MPLSLabel
+	var interfaces []InterfaceInfo
+	for _, ext := range exts {
+		switch ext := ext.(type) {
+		case *icmp.MPLSLabelStack:
+			for _, l := range ext.Labels {
+				labels = append(labels, MPLSLabel{Label: l.Label, TC: l.TC, S: l.S, TTL: l.TTL})
+			}
+		case *icmp.InterfaceInfo:
+			// the top 2 bits of C-Type are the interface role
+			info := InterfaceInfo{Role: interfaceRoles[(ext.Type>>6)&0x3]}
+			if ext.Interface != nil {
+				info.IfIndex, info.Name, info.MTU = ext.Interface.Index, ext.Interface.Name, ext.Interface.MTU
+			}
+			if ext.Addr != nil {
+				info.IP = ext.Addr.IP
+			}
+			interfaces = append(interfaces, info)
+		}
+	}
+	return labels, interfaces
+}
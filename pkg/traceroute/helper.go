@@ -4,11 +4,29 @@ import (
 	"errors"
 	"math/rand"
 	"net"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 const (
 	protocolICMPv4 = 1
+	protocolTCP    = 6
 	protocolUDP    = 17
+	protocolICMPv6 = 58
+)
+
+const defaultTCPMSS = 1460
+
+// maxRegisterAttempts limits the retries of picking an unused session id.
+const maxRegisterAttempts = 16
+
+const (
+	udpHeaderLen       = 8
+	udpChecksumOffset  = 6
+	icmpEchoHeaderLen  = 8
+	icmpChecksumOffset = 2
 )
 
 const (
@@ -35,3 +53,65 @@ func localIPv4() (net.IP, error) {
 	}
 	return nil, errors.New("no valid local ipv4 address")
 }
+
+func localIPv6() (net.IP, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range addrs {
+		if ipNet, ok := addrs[i].(*net.IPNet); ok && ipNet.IP.IsGlobalUnicast() && ipNet.IP.To4() == nil {
+			addr := make([]byte, net.IPv6len)
+			copy(addr, ipNet.IP.To16())
+			return addr, nil
+		}
+	}
+	return nil, errors.New("no valid local ipv6 address")
+}
+
+// icmpTypeNumber returns the type number of ICMPv4 or ICMPv6 message type.
+func icmpTypeNumber(typ icmp.Type) int {
+	switch t := typ.(type) {
+	case ipv4.ICMPType:
+		return int(t)
+	case ipv6.ICMPType:
+		return int(t)
+	}
+	return -1
+}
+
+// mtuPlateaus are the common MTUs in descending order (RFC 1191), which are
+// used to guess the next-hop MTU if router doesn't report it.
+var mtuPlateaus = [...]int{32000, 17914, 8166, 4352, 2002, 1492, 1006, 508, 296, 68}
+
+// nextMTU returns the MTU to probe after a probe of size is too big, which is
+// the next-hop MTU reported by router if it's valid.
+func nextMTU(reported, size int, isIPv6 bool) int {
+	minMTU := 68
+	if isIPv6 {
+		minMTU = 1280
+	}
+	if reported >= minMTU && reported < size {
+		return reported
+	}
+	for _, mtu := range mtuPlateaus {
+		if mtu < size && mtu >= minMTU {
+			return mtu
+		}
+	}
+	return minMTU
+}
+
+// mtuPayloadSize returns the payload size of UDP or ICMP echo probe of which
+// IP packet length is mtu.
+func mtuPayloadSize(mtu int, isIPv6 bool) int {
+	size := mtu - ipv4.HeaderLen - udpHeaderLen // UDP and ICMP echo headers are equal in length
+	if isIPv6 {
+		size = mtu - ipv6.HeaderLen - udpHeaderLen
+	}
+	if size < minParisPacketSize {
+		size = minParisPacketSize
+	}
+	return size
+}
@@ -0,0 +1,253 @@
+package traceroute
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net"
+	"time"
+)
+
+// The JSON encoding of results is stable: field names are snake case, IP
+// addresses are strings, and durations are float milliseconds.
+
+type jsonResult struct {
+	DstIP      net.IP      `json:"dst_ip"`
+	Reach      bool        `json:"reach"`
+	Options    Options     `json:"options"`
+	Hops       []Hop       `json:"hops"`
+	Graph      *Graph      `json:"graph,omitempty"`
+	PathMTU    int         `json:"path_mtu,omitempty"`
+	MTUChanges []MTUChange `json:"mtu_changes,omitempty"`
+}
+
+type jsonOptions struct {
+	Protocol    Protocol `json:"protocol"`
+	Port        int      `json:"port"`
+	FirstHop    int      `json:"first_hop"`
+	MaxHop      int      `json:"max_hop"`
+	Attempts    int      `json:"attempts"`
+	Timeout     float64  `json:"timeout"`
+	PacketSize  int      `json:"packet_size"`
+	Window      int      `json:"window"`
+	Paris       bool     `json:"paris"`
+	Multipath   bool     `json:"multipath"`
+	Confidence  float64  `json:"confidence,omitempty"`
+	Coalesce    bool     `json:"coalesce"`
+	LookupNames bool     `json:"lookup_names"`
+	PMTU        bool     `json:"pmtu"`
+	MTU         int      `json:"mtu,omitempty"`
+}
+
+type jsonHop struct {
+	TTL      int       `json:"ttl"`
+	Sent     int       `json:"sent"`
+	Received int       `json:"received"`
+	Nodes    []Node    `json:"nodes"`
+	Attempts []Attempt `json:"attempts"`
+}
+
+type jsonNode struct {
+	IP       net.IP    `json:"ip"`
+	Hostname string    `json:"hostname,omitempty"`
+	ASN      uint32    `json:"asn,omitempty"`
+	ASName   string    `json:"as_name,omitempty"`
+	Location *Location `json:"location,omitempty"`
+	RTTs     []float64 `json:"rtts"`
+	Sent     int       `json:"sent"`
+	Received int       `json:"received"`
+}
+
+type jsonAttempt struct {
+	Outcome    Outcome         `json:"outcome"`
+	From       net.IP          `json:"from,omitempty"`
+	RTT        float64         `json:"rtt,omitempty"`
+	Err        string          `json:"error,omitempty"`
+	ICMPType   int             `json:"icmp_type,omitempty"`
+	ICMPCode   int             `json:"icmp_code,omitempty"`
+	ReplyTTL   int             `json:"reply_ttl,omitempty"`
+	QuotedTTL  int             `json:"quoted_ttl,omitempty"`
+	MTU        int             `json:"mtu,omitempty"`
+	MPLSLabels []MPLSLabel     `json:"mpls,omitempty"`
+	Interfaces []InterfaceInfo `json:"interfaces,omitempty"`
+}
+
+func (r Result) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonResult{
+		DstIP:      r.DstIP,
+		Reach:      r.Reach,
+		Options:    r.Opts,
+		Hops:       r.Hops,
+		Graph:      r.Graph,
+		PathMTU:    r.PathMTU,
+		MTUChanges: r.MTUChanges,
+	})
+}
+
+func (r *Result) UnmarshalJSON(b []byte) error {
+	var v jsonResult
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*r = Result{
+		DstIP:      v.DstIP,
+		Reach:      v.Reach,
+		Opts:       v.Options,
+		Hops:       v.Hops,
+		Graph:      v.Graph,
+		PathMTU:    v.PathMTU,
+		MTUChanges: v.MTUChanges,
+	}
+	return nil
+}
+
+func (o Options) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonOptions{
+		Protocol:    o.Protocol,
+		Port:        o.Port,
+		FirstHop:    o.FirstHop,
+		MaxHop:      o.MaxHop,
+		Attempts:    o.Attempts,
+		Timeout:     toMillis(o.Timeout),
+		PacketSize:  o.PacketSize,
+		Window:      o.Window,
+		Paris:       o.Paris,
+		Multipath:   o.Multipath,
+		Confidence:  o.Confidence,
+		Coalesce:    o.Coalesce,
+		LookupNames: o.LookupNames,
+		PMTU:        o.PMTU,
+		MTU:         o.MTU,
+	})
+}
+
+func (o *Options) UnmarshalJSON(b []byte) error {
+	var v jsonOptions
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*o = Options{
+		Protocol:    v.Protocol,
+		Port:        v.Port,
+		FirstHop:    v.FirstHop,
+		MaxHop:      v.MaxHop,
+		Attempts:    v.Attempts,
+		Timeout:     fromMillis(v.Timeout),
+		PacketSize:  v.PacketSize,
+		Window:      v.Window,
+		Paris:       v.Paris,
+		Multipath:   v.Multipath,
+		Confidence:  v.Confidence,
+		Coalesce:    v.Coalesce,
+		LookupNames: v.LookupNames,
+		PMTU:        v.PMTU,
+		MTU:         v.MTU,
+	}
+	return nil
+}
+
+func (h Hop) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonHop{
+		TTL:      h.TTL,
+		Sent:     h.Sent,
+		Received: h.Received,
+		Nodes:    h.Nodes,
+		Attempts: h.Attempts,
+	})
+}
+
+func (h *Hop) UnmarshalJSON(b []byte) error {
+	var v jsonHop
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*h = Hop{TTL: v.TTL, Nodes: v.Nodes, Attempts: v.Attempts, Sent: v.Sent, Received: v.Received}
+	return nil
+}
+
+func (n Node) MarshalJSON() ([]byte, error) {
+	v := jsonNode{
+		IP:       n.IP,
+		Hostname: n.Hostname,
+		ASN:      n.ASN,
+		ASName:   n.ASName,
+		Location: n.Location,
+		RTTs:     make([]float64, len(n.RTTs)),
+		Sent:     n.Sent,
+		Received: n.Received,
+	}
+	for i, rtt := range n.RTTs {
+		v.RTTs[i] = toMillis(rtt)
+	}
+	return json.Marshal(v)
+}
+
+func (n *Node) UnmarshalJSON(b []byte) error {
+	var v jsonNode
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*n = Node{
+		IP:       v.IP,
+		Hostname: v.Hostname,
+		ASN:      v.ASN,
+		ASName:   v.ASName,
+		Location: v.Location,
+		Sent:     v.Sent,
+		Received: v.Received,
+	}
+	for _, rtt := range v.RTTs {
+		n.RTTs = append(n.RTTs, fromMillis(rtt))
+	}
+	return nil
+}
+
+func (a Attempt) MarshalJSON() ([]byte, error) {
+	v := jsonAttempt{
+		Outcome:    a.Outcome,
+		From:       a.From,
+		RTT:        toMillis(a.RTT),
+		ICMPType:   a.ICMPType,
+		ICMPCode:   a.ICMPCode,
+		ReplyTTL:   a.ReplyTTL,
+		QuotedTTL:  a.QuotedTTL,
+		MTU:        a.MTU,
+		MPLSLabels: a.MPLSLabels,
+		Interfaces: a.Interfaces,
+	}
+	if a.Err != nil {
+		v.Err = a.Err.Error()
+	}
+	return json.Marshal(v)
+}
+
+func (a *Attempt) UnmarshalJSON(b []byte) error {
+	var v jsonAttempt
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*a = Attempt{
+		Outcome:    v.Outcome,
+		From:       v.From,
+		RTT:        fromMillis(v.RTT),
+		ICMPType:   v.ICMPType,
+		ICMPCode:   v.ICMPCode,
+		ReplyTTL:   v.ReplyTTL,
+		QuotedTTL:  v.QuotedTTL,
+		MTU:        v.MTU,
+		MPLSLabels: v.MPLSLabels,
+		Interfaces: v.Interfaces,
+	}
+	if v.Err != "" {
+		a.Err = errors.New(v.Err)
+	}
+	return nil
+}
+
+func toMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func fromMillis(ms float64) time.Duration {
+	return time.Duration(math.Round(ms * float64(time.Millisecond)))
+}
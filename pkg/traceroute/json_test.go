@@ -0,0 +1,64 @@
+package traceroute_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/visonhuo/mykit/pkg/traceroute"
+)
+
+func TestResult_JSON(t *testing.T) {
+	result := traceroute.Result{
+		DstIP: net.ParseIP("198.51.100.1"),
+		Reach: true,
+		Opts:  traceroute.Options{Protocol: traceroute.ProtocolUDP, MaxHop: 2, Attempts: 2, Timeout: time.Second, PMTU: true, MTU: 1500},
+		Hops: []traceroute.Hop{
+			{TTL: 1, Sent: 1, Attempts: []traceroute.Attempt{
+				{Outcome: traceroute.OutcomeError, Err: errors.New("network closed")},
+				{Outcome: traceroute.OutcomeTimeout},
+			}},
+			{TTL: 2, Sent: 2, Received: 2,
+				Nodes: []traceroute.Node{{
+					IP: net.ParseIP("198.51.100.1"), Hostname: "example.net", ASN: 64500, ASName: "EXAMPLE",
+					Location: &traceroute.Location{Country: "JP", City: "Tokyo", Latitude: 35.6895, Longitude: 139.6917},
+					RTTs:     []time.Duration{1234567 * time.Nanosecond, 20 * time.Millisecond}, Sent: 2, Received: 2,
+				}},
+				Attempts: []traceroute.Attempt{
+					{Outcome: traceroute.OutcomeReply, From: net.ParseIP("198.51.100.1"), RTT: 1234567 * time.Nanosecond,
+						ICMPType: 3, ICMPCode: 3, ReplyTTL: 63, QuotedTTL: 1,
+						MPLSLabels: []traceroute.MPLSLabel{{Label: 16005, TC: 1, S: true, TTL: 1}},
+						Interfaces: []traceroute.InterfaceInfo{{Role: traceroute.InterfaceRoleIncoming, IfIndex: 7, Name: "ge-0/0/1", MTU: 1500}}},
+					{Outcome: traceroute.OutcomeReply, From: net.ParseIP("198.51.100.1"), RTT: 20 * time.Millisecond,
+						ICMPType: 3, ICMPCode: 3, ReplyTTL: 63, QuotedTTL: 1},
+				}},
+		},
+		PathMTU:    1400,
+		MTUChanges: []traceroute.MTUChange{{TTL: 2, From: net.ParseIP("192.0.2.1"), MTU: 1400}},
+	}
+
+	b, err := json.Marshal(result)
+	require.NoError(t, err)
+	var m map[string]interface{}
+	require.NoError(t, json.Unmarshal(b, &m))
+	require.Equal(t, "198.51.100.1", m["dst_ip"])
+	require.Equal(t, 1000.0, m["options"].(map[string]interface{})["timeout"])
+	node := m["hops"].([]interface{})[1].(map[string]interface{})["nodes"].([]interface{})[0].(map[string]interface{})
+	require.Equal(t, []interface{}{1.234567, 20.0}, node["rtts"])
+
+	var decoded traceroute.Result
+	require.NoError(t, json.Unmarshal(b, &decoded))
+	require.Equal(t, result, decoded)
+}
+
+func TestResult_JSON_Simulator(t *testing.T) {
+	result := simulate(t, newSimulator(), traceroute.Options{MaxHop: 4, Timeout: 100 * time.Millisecond})
+	b, err := json.Marshal(result)
+	require.NoError(t, err)
+	var decoded traceroute.Result
+	require.NoError(t, json.Unmarshal(b, &decoded))
+	require.Equal(t, result, decoded)
+}
@@ -0,0 +1,320 @@
+package traceroute
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"time"
+)
+
+const (
+	mdaMaxFlows = 256
+	mdaSource   = "source"
+	mdaStar     = "*"
+)
+
+// Graph is the directed acyclic graph of interfaces discovered by MDA.
+type Graph struct {
+	Interfaces []Interface `json:"interfaces"`
+	Links      []Link      `json:"links"`
+}
+
+// Interface is a router interface which replied to probes sent with TTL.
+type Interface struct {
+	TTL int    `json:"ttl"`
+	IP  net.IP `json:"ip"`
+}
+
+// Link connects interface From at TTL-1 (or local source address if TTL is the
+// first hop) to interface To at TTL. FlowIDs lists the flows observed passing
+// through it.
+type Link struct {
+	TTL     int    `json:"ttl"`
+	From    net.IP `json:"from"`
+	To      net.IP `json:"to"`
+	FlowIDs []int  `json:"flow_ids"`
+}
+
+type mdaProbe struct {
+	ttl  int
+	flow int
+}
+
+type mdaRecord struct {
+	probe    mdaProbe
+	round    int
+	attempt  int
+	sendTime time.Time
+}
+
+type mda struct {
+	session  *session
+	result   *Result
+	payload  []byte
+	identify int
+	nextFlow int
+	round    int
+	// records holds every probe sent, to tell late replies to probes of
+	// previous rounds from unknown ones.
+	records map[uint16]mdaRecord
+	// paths records the interface replied by every probed flow at every TTL,
+	// mdaStar is recorded if the probe timed out.
+	paths map[int]map[int]string
+}
+
+// runMDA enumerates load-balanced paths hop by hop. At every TTL, it keeps
+// sending probes of different flows through each interface of previous hop,
+// until the number of probes reaches the stopping point of discovered next
+// hops, which rejects the existence of more next hops with confidence.
+func (s *session) runMDA(result *Result) error {
+	m := mda{
+		session: s,
+		result:  result,
+		payload: make([]byte, result.Opts.PacketSize),
+		paths:   make(map[int]map[int]string),
+		records: make(map[uint16]mdaRecord),
+	}
+	dst := s.dstIP.String()
+	lastTTL := result.Opts.FirstHop
+	for ttl := result.Opts.FirstHop; ttl <= result.Opts.MaxHop; ttl++ {
+		lastTTL = ttl
+		if err := m.discover(ttl); err != nil {
+			result.Graph = m.graph(lastTTL)
+			return err
+		}
+		if m.reached(ttl, dst) {
+			break
+		}
+	}
+	result.Graph = m.graph(lastTTL)
+	return nil
+}
+
+func (m *mda) discover(ttl int) error {
+	for {
+		probes := m.plan(ttl)
+		if len(probes) == 0 {
+			return nil
+		}
+		if err := m.probe(probes); err != nil {
+			return err
+		}
+	}
+}
+
+func (m *mda) reached(ttl int, dst string) bool {
+	for _, hops := range m.paths {
+		if hops[ttl] == dst {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *mda) predecessor(flow, ttl int) (string, bool) {
+	if ttl == m.result.Opts.FirstHop {
+		return mdaSource, true
+	}
+	hop, ok := m.paths[flow][ttl-1]
+	return hop, ok
+}
+
+// plan returns the probes still needed at ttl. Flows known to pass through an
+// interface of previous hop are probed first, then new flows are generated
+// and probed at previous hop as well, to learn which interface they traverse.
+func (m *mda) plan(ttl int) []mdaProbe {
+	type vertex struct {
+		probed     int
+		succ       map[string]struct{}
+		candidates []int
+	}
+	vertices := make(map[string]*vertex)
+	for flow := 0; flow < m.nextFlow; flow++ {
+		pred, ok := m.predecessor(flow, ttl)
+		if !ok {
+			continue
+		}
+		v, ok := vertices[pred]
+		if !ok {
+			v = &vertex{succ: make(map[string]struct{})}
+			vertices[pred] = v
+		}
+		if hop, ok := m.paths[flow][ttl]; ok {
+			v.probed++
+			if hop != mdaStar {
+				v.succ[hop] = struct{}{}
+			}
+		} else {
+			v.candidates = append(v.candidates, flow)
+		}
+	}
+	if len(vertices) == 0 {
+		vertices[mdaSource] = &vertex{succ: make(map[string]struct{})}
+	}
+
+	keys := make([]string, 0, len(vertices))
+	for key := range vertices {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var probes []mdaProbe
+	var shortage int
+	for _, key := range keys {
+		v := vertices[key]
+		need := mdaStoppingPoint(len(v.succ), m.result.Opts.Confidence) - v.probed
+		if need <= 0 {
+			continue
+		}
+		n := need
+		if n > len(v.candidates) {
+			n = len(v.candidates)
+		}
+		for _, flow := range v.candidates[:n] {
+			probes = append(probes, mdaProbe{ttl: ttl, flow: flow})
+		}
+		shortage += need - n
+	}
+	for ; shortage > 0 && m.nextFlow < mdaMaxFlows; shortage-- {
+		flow := m.nextFlow
+		m.nextFlow++
+		if ttl > m.result.Opts.FirstHop {
+			probes = append(probes, mdaProbe{ttl: ttl - 1, flow: flow})
+		}
+		probes = append(probes, mdaProbe{ttl: ttl, flow: flow})
+	}
+	return probes
+}
+
+// probe sends all probes at once, then waits for their replies until timeout.
+func (m *mda) probe(probes []mdaProbe) error {
+	s, opts := m.session, m.result.Opts
+	m.round++
+	var sent int
+	for _, p := range probes {
+		if _, ok := m.paths[p.flow]; !ok {
+			m.paths[p.flow] = make(map[int]string)
+		}
+		m.paths[p.flow][p.ttl] = mdaStar
+
+		m.identify = nextIdentify(m.identify)
+		sendTime, err := s.sendProbe(opts, m.identify, p.ttl, p.flow, m.payload)
+		attempt := m.result.attempt(p.ttl, err)
+		if err != nil {
+			s.logf("Write %v packet failed (%v):%v", opts.Protocol, s.dstIP, err)
+			continue
+		}
+		m.records[uint16(m.identify)] = mdaRecord{probe: p, round: m.round, attempt: attempt, sendTime: sendTime}
+		sent++
+	}
+
+	timer := time.NewTimer(opts.Timeout)
+	defer timer.Stop()
+	for replied := 0; replied < sent; {
+		select {
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+
+		case <-s.server.close:
+			return errors.New("server closed")
+
+		case <-timer.C:
+			return nil
+
+		case pkt := <-s.packetQ:
+			identify, ok := s.probeIdentify(pkt, opts)
+			if !ok {
+				s.count(&s.server.stats.unknown)
+				continue
+			}
+			record, ok := m.records[identify]
+			if !ok {
+				s.count(&s.server.stats.unknown)
+				continue
+			}
+			if m.paths[record.probe.flow][record.probe.ttl] != mdaStar {
+				s.count(&s.server.stats.duplicate)
+				continue
+			}
+			rtt := pkt.recvTime.Sub(record.sendTime)
+			if record.round != m.round || rtt > opts.Timeout {
+				s.count(&s.server.stats.late)
+				continue
+			}
+
+			replied++
+			m.paths[record.probe.flow][record.probe.ttl] = pkt.addr.IP.String()
+			s.aggregate(m.result, record.probe.ttl, record.attempt, newReply(pkt, rtt))
+		}
+	}
+	return nil
+}
+
+func (m *mda) graph(lastTTL int) *Graph {
+	src := m.session.server.config.LocalSrcIP
+	graph := &Graph{}
+	interfaces := make(map[string]struct{})
+	links := make(map[string]int)
+	for flow := 0; flow < m.nextFlow; flow++ {
+		for ttl := m.result.Opts.FirstHop; ttl <= lastTTL; ttl++ {
+			hop, ok := m.paths[flow][ttl]
+			if !ok || hop == mdaStar {
+				continue
+			}
+			ifaceKey := fmt.Sprintf("%d|%s", ttl, hop)
+			if _, ok := interfaces[ifaceKey]; !ok {
+				interfaces[ifaceKey] = struct{}{}
+				graph.Interfaces = append(graph.Interfaces, Interface{TTL: ttl, IP: net.ParseIP(hop)})
+			}
+
+			from := src.String()
+			if ttl != m.result.Opts.FirstHop {
+				if from, ok = m.paths[flow][ttl-1]; !ok || from == mdaStar {
+					continue
+				}
+			}
+			linkKey := fmt.Sprintf("%d|%s|%s", ttl, from, hop)
+			i, ok := links[linkKey]
+			if !ok {
+				i = len(graph.Links)
+				links[linkKey] = i
+				graph.Links = append(graph.Links, Link{TTL: ttl, From: net.ParseIP(from), To: net.ParseIP(hop)})
+			}
+			graph.Links[i].FlowIDs = append(graph.Links[i].FlowIDs, flow)
+		}
+	}
+
+	sort.Slice(graph.Interfaces, func(i, j int) bool {
+		if graph.Interfaces[i].TTL != graph.Interfaces[j].TTL {
+			return graph.Interfaces[i].TTL < graph.Interfaces[j].TTL
+		}
+		return bytes.Compare(graph.Interfaces[i].IP, graph.Interfaces[j].IP) < 0
+	})
+	sort.Slice(graph.Links, func(i, j int) bool {
+		li, lj := graph.Links[i], graph.Links[j]
+		if li.TTL != lj.TTL {
+			return li.TTL < lj.TTL
+		}
+		if c := bytes.Compare(li.From, lj.From); c != 0 {
+			return c < 0
+		}
+		return bytes.Compare(li.To, lj.To) < 0
+	})
+	return graph
+}
+
+// mdaStoppingPoint returns the number of probes needed to reject the
+// hypothesis that an interface has more than k next hops with confidence,
+// assuming load balancing is uniform. It is the smallest n satisfying
+// (k+1) * (k/(k+1))^n <= 1-confidence, which gives the well known stopping
+// points 6, 11, 16, 21... for 95% confidence.
+func mdaStoppingPoint(k int, confidence float64) int {
+	if k < 1 {
+		return 1
+	}
+	n := math.Log(float64(k+1)/(1-confidence)) / math.Log(float64(k+1)/float64(k))
+	return int(math.Ceil(n))
+}
@@ -0,0 +1,176 @@
+package traceroute_test
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/visonhuo/mykit/pkg/traceroute"
+	"github.com/visonhuo/mykit/pkg/traceroute/traceroutetest"
+)
+
+func TestMDAStoppingPoint(t *testing.T) {
+	// Stopping points of 95% confidence from MDA paper, the union bound used
+	// becomes slightly conservative for larger k.
+	for k, n := range []int{1, 6, 11, 16, 21, 27, 33} {
+		require.Equal(t, n, traceroute.MDAStoppingPoint(k, 0.95), "k=%d", k)
+	}
+	require.Greater(t, traceroute.MDAStoppingPoint(1, 0.99), traceroute.MDAStoppingPoint(1, 0.95))
+}
+
+// countingTransport counts the probes sent with every TTL.
+type countingTransport struct {
+	*traceroutetest.Network
+	mu   sync.Mutex
+	sent map[int]int
+}
+
+func (t *countingTransport) Send(probe traceroute.Probe) error {
+	t.mu.Lock()
+	t.sent[probe.TTL]++
+	t.mu.Unlock()
+	return t.Network.Send(probe)
+}
+
+// fanout returns the routers 10.0.<layer>.1 to 10.0.<layer>.n.
+func fanout(layer, n int) []string {
+	ips := make([]string, n)
+	for i := range ips {
+		ips[i] = fmt.Sprintf("10.0.%d.%d", layer, i+1)
+	}
+	return ips
+}
+
+// diamond connects from to every router of middle, and every router of
+// middle to to.
+func diamond(network *traceroutetest.Network, from string, middle []string, to string) {
+	for _, ip := range middle {
+		network.AddRouter(ip)
+		network.Chain(time.Millisecond, from, ip, to)
+	}
+}
+
+func TestMDA(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		build func(network *traceroutetest.Network)
+		// interfaces are the expected interfaces of every TTL
+		interfaces [][]string
+		// links are the expected links of TTL 2 and 3, unchecked if nil
+		links []string
+	}{
+		{
+			name: "linear",
+			build: func(network *traceroutetest.Network) {
+				network.AddRouter("10.0.1.1")
+				network.AddRouter("10.0.2.1")
+				network.Chain(time.Millisecond, simSrc, "10.0.1.1", "10.0.2.1", simDst)
+			},
+			interfaces: [][]string{{"10.0.1.1"}, {"10.0.2.1"}, {simDst}},
+			links:      []string{"10.0.1.1-10.0.2.1", "10.0.2.1-" + simDst},
+		},
+		{
+			name: "fanout5",
+			build: func(network *traceroutetest.Network) {
+				network.AddRouter("10.0.1.1")
+				network.AddRouter("10.0.3.1")
+				network.Chain(time.Millisecond, simSrc, "10.0.1.1")
+				diamond(network, "10.0.1.1", fanout(2, 5), "10.0.3.1")
+				network.Chain(time.Millisecond, "10.0.3.1", simDst)
+			},
+			interfaces: [][]string{{"10.0.1.1"}, fanout(2, 5), {"10.0.3.1"}, {simDst}},
+		},
+		{
+			name: "fanout12",
+			build: func(network *traceroutetest.Network) {
+				network.AddRouter("10.0.1.1")
+				network.AddRouter("10.0.3.1")
+				network.Chain(time.Millisecond, simSrc, "10.0.1.1")
+				diamond(network, "10.0.1.1", fanout(2, 12), "10.0.3.1")
+				network.Chain(time.Millisecond, "10.0.3.1", simDst)
+			},
+			interfaces: [][]string{{"10.0.1.1"}, fanout(2, 12), {"10.0.3.1"}, {simDst}},
+		},
+		{
+			// every interface of TTL 2 is probed by flows known to pass
+			// through it, which reveals the successors of each
+			name: "nodeControl",
+			build: func(network *traceroutetest.Network) {
+				network.AddRouter("10.0.1.1")
+				network.AddRouter("10.0.4.1")
+				network.Chain(time.Millisecond, simSrc, "10.0.1.1")
+				network.AddRouter("10.0.2.1")
+				network.AddRouter("10.0.2.2")
+				network.Chain(time.Millisecond, "10.0.1.1", "10.0.2.1")
+				network.Chain(time.Millisecond, "10.0.1.1", "10.0.2.2")
+				diamond(network, "10.0.2.1", []string{"10.0.3.1", "10.0.3.2", "10.0.3.3"}, "10.0.4.1")
+				diamond(network, "10.0.2.2", []string{"10.0.3.4", "10.0.3.5", "10.0.3.6"}, "10.0.4.1")
+				network.Chain(time.Millisecond, "10.0.4.1", simDst)
+			},
+			interfaces: [][]string{{"10.0.1.1"}, fanout(2, 2), fanout(3, 6), {"10.0.4.1"}, {simDst}},
+			links: []string{
+				"10.0.1.1-10.0.2.1", "10.0.1.1-10.0.2.2",
+				"10.0.2.1-10.0.3.1", "10.0.2.1-10.0.3.2", "10.0.2.1-10.0.3.3",
+				"10.0.2.2-10.0.3.4", "10.0.2.2-10.0.3.5", "10.0.2.2-10.0.3.6",
+			},
+		},
+		{
+			name: "perPacket",
+			build: func(network *traceroutetest.Network) {
+				network.AddRouter("10.0.1.1").PerPacket = true
+				network.AddRouter("10.0.3.1")
+				network.Chain(time.Millisecond, simSrc, "10.0.1.1")
+				diamond(network, "10.0.1.1", fanout(2, 3), "10.0.3.1")
+				network.Chain(time.Millisecond, "10.0.3.1", simDst)
+			},
+			interfaces: [][]string{{"10.0.1.1"}, fanout(2, 3), {"10.0.3.1"}, {simDst}},
+			links: []string{
+				"10.0.1.1-10.0.2.1", "10.0.1.1-10.0.2.2", "10.0.1.1-10.0.2.3",
+				"10.0.2.1-10.0.3.1", "10.0.2.2-10.0.3.1", "10.0.2.3-10.0.3.1",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			network := traceroutetest.NewNetwork(simSrc, 1)
+			network.AddHost(simDst)
+			tc.build(network)
+			opts := traceroute.Options{Multipath: true, MaxHop: 8, Timeout: 100 * time.Millisecond}
+			transport := &countingTransport{Network: network, sent: make(map[int]int)}
+			result := simulate(t, transport, opts)
+			require.True(t, result.Reach)
+			require.NotNil(t, result.Graph)
+
+			// discovery stops at destination
+			interfaces := make([][]string, len(tc.interfaces))
+			for _, iface := range result.Graph.Interfaces {
+				require.LessOrEqual(t, iface.TTL, len(tc.interfaces))
+				interfaces[iface.TTL-1] = append(interfaces[iface.TTL-1], iface.IP.String())
+			}
+			require.Equal(t, tc.interfaces, interfaces)
+
+			var links []string
+			for _, link := range result.Graph.Links {
+				require.NotEmpty(t, link.FlowIDs)
+				if link.TTL == 1 {
+					require.Equal(t, simSrc, link.From.String())
+					continue
+				}
+				if link.TTL <= 3 {
+					links = append(links, link.From.String()+"-"+link.To.String())
+				}
+			}
+			sort.Strings(links)
+			if tc.links != nil {
+				require.Equal(t, tc.links, links)
+			}
+			// the first hop is probed by the flows enumerating its successors
+			// only, which stop right at the stopping point of them
+			transport.mu.Lock()
+			defer transport.mu.Unlock()
+			require.Equal(t, traceroute.MDAStoppingPoint(len(tc.interfaces[1]), 0.95), transport.sent[1])
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package traceroute
+
+import (
+	"context"
+	"math"
+	"net"
+	"time"
+)
+
+// Snapshot is the rolling statistics of a monitored path after a round.
+type Snapshot struct {
+	DstIP net.IP
+	Round int
+	Reach bool // whether destination is reached in the last round
+	Hops  []HopSummary
+	// Err is the error of the last round, the statistics of failed rounds
+	// are kept but not updated.
+	Err error
+}
+
+// HopSummary is the statistics of a TTL accumulated over rounds, in the
+// style of mtr.
+type HopSummary struct {
+	TTL int
+	// IPs are the nodes replied to TTL, in the order they were seen.
+	IPs      []net.IP
+	Sent     int
+	Received int
+	// Loss is the percentage of probes not replied.
+	Loss   float64
+	Last   time.Duration
+	Avg    time.Duration
+	Best   time.Duration
+	Worst  time.Duration
+	StdDev time.Duration
+}
+
+// Monitor traces target in rounds continuously like mtr, a round starts
+// every interval (or once the last one finished, if it takes longer). The
+// snapshot of statistics accumulated over rounds is published to the
+// returned channel after every round, which is closed once ctx is done or
+// Server is shut down. Caller must drain the channel until it is closed.
+func (s *Server) Monitor(ctx context.Context, target string, opts Options, interval time.Duration) (<-chan Snapshot, error) {
+	ipAddr, err := net.ResolveIPAddr(s.config.Network, target)
+	if err != nil {
+		return nil, err
+	}
+	// check options by the first round
+	future, err := s.Traceroute(ctx, ipAddr.IP.String(), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan Snapshot)
+	go func() {
+		defer close(ch)
+		m := &monitor{dstIP: ipAddr.IP, hops: make(map[int]*hopAccumulator)}
+		for {
+			start := time.Now()
+			result, err := future.Result(), future.Error()
+			select {
+			case <-ctx.Done():
+				return // the last round is interrupted
+			default:
+			}
+			m.merge(result, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.close:
+				return
+			case ch <- m.snapshot():
+			}
+
+			timer := time.NewTimer(interval - time.Since(start))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-s.close:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			if future, err = s.Traceroute(ctx, ipAddr.IP.String(), opts); err != nil {
+				future = newFuture() // publish the failed round
+				future.done(Result{DstIP: ipAddr.IP, Opts: opts}, err)
+			}
+		}
+	}()
+	return ch, nil
+}
+
+type monitor struct {
+	dstIP net.IP
+	round int
+	reach bool
+	err   error
+	hops  map[int]*hopAccumulator
+	// maxTTL is the greatest TTL probed by the last round, the hops beyond it
+	// are no longer on path.
+	maxTTL int
+}
+
+type hopAccumulator struct {
+	ips      []net.IP
+	sent     int
+	received int
+	last     time.Duration
+	best     time.Duration
+	worst    time.Duration
+	// mean and m2 are the running mean and sum of squared deviations of
+	// RTTs by Welford's algorithm, which keeps precise for large RTTs.
+	mean float64
+	m2   float64
+}
+
+func (m *monitor) merge(result Result, err error) {
+	m.round++
+	m.err = err
+	if err != nil {
+		return
+	}
+	m.reach = result.Reach
+	m.maxTTL = 0
+	for _, hop := range result.Hops {
+		acc, ok := m.hops[hop.TTL]
+		if !ok {
+			acc = &hopAccumulator{}
+			m.hops[hop.TTL] = acc
+		}
+		if hop.TTL > m.maxTTL {
+			m.maxTTL = hop.TTL
+		}
+		acc.sent += hop.Sent
+		for _, attempt := range hop.Attempts {
+			if attempt.Outcome == OutcomeReply {
+				acc.add(attempt.From, attempt.RTT)
+			}
+		}
+	}
+}
+
+func (a *hopAccumulator) add(from net.IP, rtt time.Duration) {
+	seen := false
+	for _, ip := range a.ips {
+		if ip.Equal(from) {
+			seen = true
+			break
+		}
+	}
+	if !seen {
+		a.ips = append(a.ips, from)
+	}
+	if a.received == 0 || rtt < a.best {
+		a.best = rtt
+	}
+	if rtt > a.worst {
+		a.worst = rtt
+	}
+	a.received++
+	a.last = rtt
+	delta := float64(rtt) - a.mean
+	a.mean += delta / float64(a.received)
+	a.m2 += delta * (float64(rtt) - a.mean)
+}
+
+func (m *monitor) snapshot() Snapshot {
+	snapshot := Snapshot{DstIP: m.dstIP, Round: m.round, Reach: m.reach, Err: m.err}
+	for ttl := 1; ttl <= m.maxTTL; ttl++ {
+		acc, ok := m.hops[ttl]
+		if !ok {
+			continue
+		}
+		summary := HopSummary{
+			TTL:      ttl,
+			IPs:      append([]net.IP(nil), acc.ips...),
+			Sent:     acc.sent,
+			Received: acc.received,
+			Last:     acc.last,
+			Best:     acc.best,
+			Worst:    acc.worst,
+		}
+		if acc.sent > 0 && acc.sent >= acc.received {
+			summary.Loss = float64(acc.sent-acc.received) * 100 / float64(acc.sent)
+		}
+		if acc.received > 0 {
+			summary.Avg = time.Duration(acc.mean)
+			summary.StdDev = time.Duration(math.Sqrt(acc.m2 / float64(acc.received)))
+		}
+		snapshot.Hops = append(snapshot.Hops, summary)
+	}
+	return snapshot
+}
@@ -0,0 +1,26 @@
+package traceroute
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMonitor_StdDev(t *testing.T) {
+	// RTTs of a few seconds deviating by microseconds, of which the sum of
+	// squares loses the deviation in float64 precision.
+	m := &monitor{hops: make(map[int]*hopAccumulator)}
+	from := net.ParseIP("192.0.2.1")
+	var result Result
+	for _, rtt := range []time.Duration{10*time.Second - time.Microsecond, 10 * time.Second, 10*time.Second + time.Microsecond} {
+		result.aggregate(1, result.attempt(1, nil), Attempt{Outcome: OutcomeReply, From: from, RTT: rtt})
+	}
+	m.merge(result, nil)
+
+	snapshot := m.snapshot()
+	require.Len(t, snapshot.Hops, 1)
+	require.Equal(t, 10*time.Second, snapshot.Hops[0].Avg)
+	require.Equal(t, 816*time.Nanosecond, snapshot.Hops[0].StdDev) // sqrt(2/3) us
+}
@@ -4,25 +4,86 @@ import "time"
 
 const (
 	defaultPort       = 33434
+	defaultTCPPort    = 80
 	defaultFirstHop   = 1
 	defaultMaxHop     = 64
 	defaultTimeout    = 1 * time.Second
 	defaultAttempts   = 3
 	defaultPacketSize = 16
+	defaultConfidence = 0.95
+	defaultWindow     = 5
+	defaultMTU        = 1500 // Ethernet
+
+	// minParisPacketSize leaves room in payload for tweaking the checksum.
+	minParisPacketSize = 2
+)
+
+// Protocol specifies which kind of probe packet is sent by a session.
+type Protocol string
+
+const (
+	ProtocolUDP  Protocol = "udp"
+	ProtocolICMP Protocol = "icmp"
+	ProtocolTCP  Protocol = "tcp"
 )
 
 type Options struct {
-	Port       int
-	FirstHop   int
-	MaxHop     int
-	Attempts   int
-	Timeout    time.Duration
+	// Protocol specifies the probe packet type, default is ProtocolUDP.
+	Protocol Protocol
+	// Port is the base destination port of UDP probes, which increases with
+	// every probe, or the fixed destination port of TCP SYN probes.
+	// Default is 33434 for UDP and 80 for TCP.
+	Port     int
+	FirstHop int
+	MaxHop   int
+	Attempts int
+	Timeout  time.Duration
+	// PacketSize is the payload size of probes, default is 16. Paris probes
+	// need at least 2 bytes of payload to pin the checksum.
 	PacketSize int
+	// Window is the number of TTLs probed ahead of the lowest TTL still
+	// waiting for replies, default is 5. Probing stops once the destination
+	// is reached, so the hops beyond it are never probed.
+	Window int
+	// Paris enables Paris-traceroute style probing, which keeps the flow
+	// identifier (5-tuple and ICMP checksum) constant for every probe of a
+	// session, so that ECMP routers forward all probes along the same path.
+	// The probe identity is encoded in IP ID, UDP checksum or ICMP sequence.
+	Paris bool
+	// Multipath enables Multipath Detection Algorithm (MDA), which enumerates
+	// load-balanced paths by varying the flow identifier of Paris probes,
+	// the discovered paths are reported by Result.Graph. Only UDP and ICMP
+	// probes are supported.
+	Multipath bool
+	// Confidence is the probability that MDA discovers all next hops of an
+	// interface before it stops probing, default is 0.95.
+	Confidence float64
+	// Coalesce shares the running session to the same destination with
+	// equal options, instead of starting a new one. Only the sessions started
+	// with Coalesce enabled are shared.
+	Coalesce bool
+	// LookupNames looks up hostnames of hops by reverse DNS before the result
+	// is finished, see Config.Resolver.
+	LookupNames bool
+	// PMTU enables path MTU discovery, probes are sized to the MTU of path
+	// instead of PacketSize, and shrunk on ICMP "fragmentation needed" (or
+	// ICMPv6 "packet too big") replies, see Result.PathMTU. Only UDP and
+	// ICMP probes are supported.
+	PMTU bool
+	// MTU is the initial length of probe IP packets in PMTU mode, which is
+	// usually the MTU of local interface, default is 1500.
+	MTU int
 }
 
 func (o *Options) init() {
+	if o.Protocol != ProtocolICMP && o.Protocol != ProtocolTCP {
+		o.Protocol = ProtocolUDP
+	}
 	if o.Port <= 0 {
 		o.Port = defaultPort
+		if o.Protocol == ProtocolTCP {
+			o.Port = defaultTCPPort
+		}
 	}
 	if o.MaxHop <= 0 {
 		o.MaxHop = defaultMaxHop
@@ -36,7 +97,19 @@ func (o *Options) init() {
 	if o.PacketSize <= 0 {
 		o.PacketSize = defaultPacketSize
 	}
+	if o.Multipath {
+		o.Paris = true
+		if o.Confidence <= 0 || o.Confidence >= 1 {
+			o.Confidence = defaultConfidence
+		}
+	}
 	if o.Attempts <= 0 {
 		o.Attempts = defaultAttempts
 	}
+	if o.Window <= 0 {
+		o.Window = defaultWindow
+	}
+	if o.PMTU && o.MTU <= 0 {
+		o.MTU = defaultMTU
+	}
 }
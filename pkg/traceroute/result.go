@@ -2,7 +2,13 @@ package traceroute
 
 import (
 	"net"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 type Result struct {
@@ -10,55 +16,291 @@ type Result struct {
 	Reach bool
 	Hops  []Hop
 	Opts  Options
+	// Graph is the load-balanced paths discovered by MDA, which is only
+	// available if Options.Multipath is enabled.
+	Graph *Graph
+	// PathMTU is the MTU of path probed, and MTUChanges are the hops where
+	// it drops. They are only available if Options.PMTU is enabled.
+	PathMTU    int
+	MTUChanges []MTUChange
+}
+
+// MTUChange is a drop of MTU along the path.
+type MTUChange struct {
+	// TTL is the first hop beyond the link of MTU, and From is the router
+	// which reported the MTU.
+	TTL  int    `json:"ttl"`
+	From net.IP `json:"from"`
+	MTU  int    `json:"mtu"`
 }
 
+// Hop is the probing result of a TTL. Every probed TTL is recorded, the hop
+// replied by none of probes has no Nodes.
 type Hop struct {
 	TTL   int
 	Nodes []Node
+	// Attempts is the outcome of every probe sent to TTL in sending order.
+	Attempts []Attempt
+	Sent     int
+	Received int
 }
 
+// Node is a router interface or the destination replied to probes of a hop.
 type Node struct {
-	IP   net.IP
+	IP net.IP
+	// Hostname is the reverse DNS name of IP, which is only looked up if
+	// Options.LookupNames is enabled.
+	Hostname string
+	// ASN and ASName are the autonomous system of IP, see Result.EnrichASN.
+	ASN    uint32
+	ASName string
+	// Location is the geographical location of IP if known, see
+	// Result.EnrichGeo.
+	Location *Location
+	// RTTs are the round trip times of replies from node in the sending
+	// order of probes, rather than the arrival order of replies.
 	RTTs []time.Duration
+	// Sent is the number of probes sent to the hop of node, and Received is
+	// the number of them replied by node.
+	Sent     int
+	Received int
 }
 
-func (r *Result) aggregate(ttl int, from net.IP, rtt time.Duration) {
+// Outcome is the outcome of a probe.
+type Outcome string
+
+const (
+	OutcomeReply   Outcome = "reply"
+	OutcomeTimeout Outcome = "timeout"
+	OutcomeError   Outcome = "error"
+	// OutcomeTooBig is the probe too big to be forwarded along the path in
+	// PMTU mode, which is resent in smaller size. The reply is the ICMP
+	// error of router before the link of smaller MTU, rather than the hop.
+	OutcomeTooBig Outcome = "too-big"
+)
+
+// Attempt is the outcome of a probe. Err is the sending error if Outcome is
+// OutcomeError, and the other fields describe the reply if Outcome is
+// OutcomeReply.
+type Attempt struct {
+	Outcome Outcome
+	From    net.IP
+	RTT     time.Duration
+	Err     error
+	// ICMPType and ICMPCode are the type and code of ICMP reply (ICMPv6 if
+	// From is an IPv6 address), they are zero for TCP replies.
+	ICMPType int
+	ICMPCode int
+	// ReplyTTL is the TTL of reply when it's received, zero if unknown.
+	ReplyTTL int
+	// QuotedTTL is the TTL of probe when it arrived at the replying node,
+	// which is quoted by ICMP errors. It's expected to be 1 for ICMP Time
+	// Exceeded, a greater one implies the probe was forwarded by a hidden
+	// router (or TTL was rewritten). It's zero if the reply quotes nothing.
+	QuotedTTL int
+	// MTU is the next-hop MTU reported by ICMP "fragmentation needed" or
+	// ICMPv6 "packet too big".
+	MTU int
+	// MPLSLabels and Interfaces are the ICMP extensions of reply, which are
+	// only available if replying router supports them.
+	MPLSLabels []MPLSLabel
+	Interfaces []InterfaceInfo
+}
+
+// Annotation returns the annotation of reply printed by classic traceroute:
+// "!N" network unreachable, "!H" host unreachable, "!P" protocol unreachable,
+// "!X" communication administratively prohibited, "!F-<mtu>" fragmentation
+// needed, "!S" source route failed, "!V" host precedence violation, "!C"
+// precedence cutoff, or "!<code>" for other unreachable codes. It returns an
+// empty string for other replies, including port unreachable.
+func (a Attempt) Annotation() string {
+	if a.Outcome != OutcomeReply && a.Outcome != OutcomeTooBig || a.From == nil {
+		return ""
+	}
+	if a.From.To4() == nil {
+		switch a.ICMPType {
+		case int(ipv6.ICMPTypeDestinationUnreachable):
+			switch a.ICMPCode {
+			case 0:
+				return "!N"
+			case 1, 5, 6:
+				return "!X"
+			case 2:
+				return "!S"
+			case 3:
+				return "!H"
+			case 4:
+				return ""
+			}
+			return "!<" + strconv.Itoa(a.ICMPCode) + ">"
+		case int(ipv6.ICMPTypePacketTooBig):
+			return "!F-" + strconv.Itoa(a.MTU)
+		}
+		return ""
+	}
+	if a.ICMPType != int(ipv4.ICMPTypeDestinationUnreachable) {
+		return ""
+	}
+	switch a.ICMPCode {
+	case 0, 6, 8, 11: // network unreachable, unknown, isolated, for TOS
+		return "!N"
+	case 1, 7, 12: // host unreachable, unknown, for TOS
+		return "!H"
+	case 2:
+		return "!P"
+	case 3:
+		return ""
+	case 4:
+		return "!F-" + strconv.Itoa(a.MTU)
+	case 5:
+		return "!S"
+	case 9, 10, 13: // network, host or communication administratively prohibited
+		return "!X"
+	case 14:
+		return "!V"
+	case 15:
+		return "!C"
+	}
+	return "!<" + strconv.Itoa(a.ICMPCode) + ">"
+}
+
+// hop returns the hop record of ttl, it's created in TTL order if absent.
+func (r *Result) hop(ttl int) *Hop {
+	i := sort.Search(len(r.Hops), func(i int) bool { return r.Hops[i].TTL >= ttl })
+	if i == len(r.Hops) || r.Hops[i].TTL != ttl {
+		r.Hops = append(r.Hops, Hop{})
+		copy(r.Hops[i+1:], r.Hops[i:])
+		r.Hops[i] = Hop{TTL: ttl}
+	}
+	return &r.Hops[i]
+}
+
+// attempt records a probe sent to ttl, which is timed out until a reply is
+// aggregated. If err isn't nil, probe is failed to send. It returns the index
+// of attempt in hop.
+func (r *Result) attempt(ttl int, err error) int {
+	hop := r.hop(ttl)
+	if err != nil {
+		hop.Attempts = append(hop.Attempts, Attempt{Outcome: OutcomeError, Err: err})
+		return len(hop.Attempts) - 1
+	}
+	hop.Attempts = append(hop.Attempts, Attempt{Outcome: OutcomeTimeout})
+	hop.Sent++
+	for i := range hop.Nodes {
+		hop.Nodes[i].Sent = hop.Sent
+	}
+	return len(hop.Attempts) - 1
+}
+
+// aggregate records the reply to the attempt of ttl.
+func (r *Result) aggregate(ttl, attempt int, reply Attempt) {
+	from, rtt := reply.From, reply.RTT
 	if from.Equal(r.DstIP) {
 		r.Reach = true
 	}
 
-	for i := range r.Hops {
-		if r.Hops[i].TTL == ttl { // exist hop record
-			for j := range r.Hops[i].Nodes {
-				if r.Hops[i].Nodes[j].IP.Equal(from) { // exist node record
-					r.Hops[i].Nodes[j].RTTs = append(r.Hops[i].Nodes[j].RTTs, rtt)
-					return
-				}
-				r.Hops[i].Nodes = append(r.Hops[i].Nodes, Node{
-					IP:   from,
-					RTTs: []time.Duration{rtt},
-				})
-				return
+	hop := r.hop(ttl)
+	pos := -1 // position of rtt in RTTs of node, -1 to append
+	if attempt >= 0 && attempt < len(hop.Attempts) {
+		hop.Attempts[attempt] = reply
+		pos = 0
+		for _, prev := range hop.Attempts[:attempt] {
+			if prev.Outcome == OutcomeReply && prev.From.Equal(from) {
+				pos++
+			}
+		}
+	}
+	hop.Received++
+	for i := range hop.Nodes {
+		if node := &hop.Nodes[i]; node.IP.Equal(from) { // exist node record
+			if pos < 0 || pos > len(node.RTTs) {
+				pos = len(node.RTTs)
 			}
+			node.RTTs = append(node.RTTs, 0)
+			copy(node.RTTs[pos+1:], node.RTTs[pos:])
+			node.RTTs[pos] = rtt
+			node.Received++
+			return
 		}
 	}
+	hop.Nodes = append(hop.Nodes, Node{
+		IP:       from,
+		RTTs:     []time.Duration{rtt},
+		Sent:     hop.Sent,
+		Received: 1,
+	})
+}
+
+// Event is a reply aggregated into Result while the traceroute is running.
+// The last event of a subscription has Done set, and carries the final Result
+// and error of Future instead.
+type Event struct {
+	TTL  int
+	IP   net.IP
+	RTT  time.Duration
+	Done bool
+
+	Result Result
+	Err    error
+}
 
-	nodes := make([]Node, 0, r.Opts.Attempts)
-	nodes = append(nodes, Node{IP: from, RTTs: []time.Duration{rtt}})
-	if r.Hops == nil {
-		r.Hops = make([]Hop, 0, r.Opts.MaxHop-r.Opts.FirstHop)
+// tooBig records the reply to the attempt of ttl is a "packet too big" error,
+// the attempt isn't counted as sent to the hop.
+func (r *Result) tooBig(ttl, attempt int, reply Attempt) {
+	hop := r.hop(ttl)
+	if attempt < 0 || attempt >= len(hop.Attempts) {
+		return
+	}
+	reply.Outcome = OutcomeTooBig
+	hop.Attempts[attempt] = reply
+	hop.Sent--
+	for i := range hop.Nodes {
+		hop.Nodes[i].Sent = hop.Sent
+	}
+}
+
+// dropMTU records the MTU reported by router from is dropped to mtu beyond
+// it, which is found by the probe of ttl.
+func (r *Result) dropMTU(ttl int, from net.IP, mtu int) {
+	for i := range r.MTUChanges {
+		if change := &r.MTUChanges[i]; change.MTU == mtu {
+			if ttl < change.TTL {
+				change.TTL, change.From = ttl, from
+			}
+			return
+		}
+	}
+	r.MTUChanges = append(r.MTUChanges, MTUChange{TTL: ttl, From: from, MTU: mtu})
+	sort.Slice(r.MTUChanges, func(i, j int) bool { return r.MTUChanges[i].TTL < r.MTUChanges[j].TTL })
+}
+
+// truncate drops the hops beyond maxTTL.
+func (r *Result) truncate(maxTTL int) {
+	hops := r.Hops[:0]
+	for _, hop := range r.Hops {
+		if hop.TTL <= maxTTL {
+			hops = append(hops, hop)
+		}
 	}
-	r.Hops = append(r.Hops, Hop{TTL: ttl, Nodes: nodes})
-	return
+	r.Hops = hops
 }
 
 type Future struct {
 	finish   chan struct{}
+	mu       sync.Mutex
+	cond     *sync.Cond
+	events   []Event
 	finished bool
 	result   Result
 	err      error
 }
 
+func newFuture() *Future {
+	f := &Future{finish: make(chan struct{})}
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
 func (f *Future) Error() error {
 	<-f.finish
 	return f.err
@@ -69,13 +311,48 @@ func (f *Future) Result() Result {
 	return f.result
 }
 
+// Subscribe returns a channel of the reply events of traceroute. Events
+// aggregated before subscribing are replayed first, and the channel is closed
+// after the final event with Done set. Caller should drain the channel until
+// it is closed, otherwise the delivering goroutine would be leaked.
+func (f *Future) Subscribe() <-chan Event {
+	ch := make(chan Event)
+	go func() {
+		defer close(ch)
+		for next := 0; ; {
+			f.mu.Lock()
+			for next >= len(f.events) {
+				f.cond.Wait()
+			}
+			events := f.events[next:]
+			next = len(f.events)
+			f.mu.Unlock()
+
+			for _, event := range events {
+				ch <- event
+				if event.Done {
+					return
+				}
+			}
+		}
+	}()
+	return ch
+}
+
+func (f *Future) publish(ttl int, from net.IP, rtt time.Duration) {
+	f.mu.Lock()
+	f.events = append(f.events, Event{TTL: ttl, IP: from, RTT: rtt})
+	f.mu.Unlock()
+	f.cond.Broadcast()
+}
+
 func (f *Future) done(result Result, err error) {
+	f.mu.Lock()
 	f.result = result
 	f.err = err
 	f.finished = true
+	f.events = append(f.events, Event{Done: true, Result: result, Err: err})
+	f.mu.Unlock()
+	f.cond.Broadcast()
 	close(f.finish)
 }
-
-func (f *Future) isDone() bool {
-	return f.finished
-}
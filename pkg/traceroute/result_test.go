@@ -0,0 +1,114 @@
+package traceroute_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/visonhuo/mykit/pkg/traceroute"
+)
+
+func TestAttempt_Annotation(t *testing.T) {
+	v4, v6 := net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")
+	for _, tc := range []struct {
+		attempt traceroute.Attempt
+		want    string
+	}{
+		{traceroute.Attempt{From: v4, ICMPType: 11}, ""},
+		{traceroute.Attempt{From: v4, ICMPType: 3, ICMPCode: 0}, "!N"},
+		{traceroute.Attempt{From: v4, ICMPType: 3, ICMPCode: 1}, "!H"},
+		{traceroute.Attempt{From: v4, ICMPType: 3, ICMPCode: 2}, "!P"},
+		{traceroute.Attempt{From: v4, ICMPType: 3, ICMPCode: 3}, ""},
+		{traceroute.Attempt{From: v4, ICMPType: 3, ICMPCode: 4, MTU: 1400}, "!F-1400"},
+		{traceroute.Attempt{From: v4, ICMPType: 3, ICMPCode: 13}, "!X"},
+		{traceroute.Attempt{From: v4, ICMPType: 3, ICMPCode: 16}, "!<16>"},
+		{traceroute.Attempt{From: v6, ICMPType: 3}, ""}, // time exceeded
+		{traceroute.Attempt{From: v6, ICMPType: 1, ICMPCode: 0}, "!N"},
+		{traceroute.Attempt{From: v6, ICMPType: 1, ICMPCode: 1}, "!X"},
+		{traceroute.Attempt{From: v6, ICMPType: 1, ICMPCode: 3}, "!H"},
+		{traceroute.Attempt{From: v6, ICMPType: 1, ICMPCode: 4}, ""},
+		{traceroute.Attempt{From: v6, ICMPType: 2, MTU: 1280}, "!F-1280"},
+	} {
+		tc.attempt.Outcome = traceroute.OutcomeReply
+		require.Equal(t, tc.want, tc.attempt.Annotation(), "%+v", tc.attempt)
+	}
+	require.Empty(t, traceroute.Attempt{Outcome: traceroute.OutcomeTimeout}.Annotation())
+}
+
+func TestResult_ReturnPaths(t *testing.T) {
+	result := newResult([]string{"10.0.0.1"}, []string{"192.0.2.1", "192.0.2.2"}, nil, []string{"198.51.100.1"})
+	reply := func(ip string, ttl int) traceroute.Attempt {
+		return traceroute.Attempt{Outcome: traceroute.OutcomeReply, From: net.ParseIP(ip), ReplyTTL: ttl}
+	}
+	result.Hops[0].Attempts = []traceroute.Attempt{reply("10.0.0.1", 255), reply("10.0.0.1", 255)}
+	result.Hops[1].Attempts = []traceroute.Attempt{reply("192.0.2.1", 253), reply("192.0.2.2", 0)}
+	result.Hops[2].Attempts = []traceroute.Attempt{{Outcome: traceroute.OutcomeTimeout}}
+	result.Hops[3].Attempts = []traceroute.Attempt{
+		{Outcome: traceroute.OutcomeTimeout},
+		reply("198.51.100.1", 56),
+		reply("198.51.100.1", 58),
+	}
+
+	require.Equal(t, []traceroute.ReturnPath{
+		{TTL: 1, IP: net.ParseIP("10.0.0.1"), ReplyTTL: 255, InitialTTL: 255, Hops: 1},
+		{TTL: 2, IP: net.ParseIP("192.0.2.1"), ReplyTTL: 253, InitialTTL: 255, Hops: 3, Delta: 1},
+		{TTL: 4, IP: net.ParseIP("198.51.100.1"), ReplyTTL: 58, InitialTTL: 64, Hops: 7, Delta: 3, Asymmetric: true},
+	}, result.ReturnPaths())
+}
+
+func TestHop_Stats(t *testing.T) {
+	ms := func(ms ...int) []time.Duration {
+		var rtts []time.Duration
+		for _, v := range ms {
+			rtts = append(rtts, time.Duration(v)*time.Millisecond)
+		}
+		return rtts
+	}
+	// 10 probes are sent to hop, which are load balanced onto 2 nodes.
+	hop := traceroute.Hop{TTL: 3, Sent: 10, Received: 8, Nodes: []traceroute.Node{
+		{IP: net.ParseIP("192.0.2.1"), Sent: 10, Received: 4, RTTs: ms(10, 12, 11, 15)},
+		{IP: net.ParseIP("192.0.2.2"), Sent: 10, Received: 4, RTTs: ms(30, 30, 34, 30)},
+	}}
+
+	node := hop.Nodes[0].Stats()
+	require.Equal(t, 60.0, node.Loss)
+	require.Equal(t, 10*time.Millisecond, node.Min)
+	require.Equal(t, 15*time.Millisecond, node.Max)
+	require.Equal(t, 12*time.Millisecond, node.Avg)
+	require.Equal(t, 11500*time.Microsecond, node.Median)
+	require.Equal(t, time.Duration(1870828), node.StdDev) // sqrt(3.5) ms
+	require.Equal(t, (2+1+4)*time.Millisecond/3, node.Jitter)
+
+	stats := hop.Stats()
+	require.Equal(t, 10, stats.Sent)
+	require.Equal(t, 8, stats.Received)
+	require.Equal(t, 20.0, stats.Loss)
+	require.Equal(t, 10*time.Millisecond, stats.Min)
+	require.Equal(t, 34*time.Millisecond, stats.Max)
+	require.Equal(t, 21500*time.Microsecond, stats.Avg)
+	require.Equal(t, 22500*time.Microsecond, stats.Median)
+	// jitter doesn't count the difference between nodes
+	require.Equal(t, (2+1+4+0+4+4)*time.Millisecond/6, stats.Jitter)
+
+	require.Equal(t, traceroute.RTTStats{Sent: 3, Loss: 100}, traceroute.Hop{Sent: 3}.Stats())
+
+	// replies arrive out of order, RTTs and jitter follow the sending order
+	var reordered traceroute.Result
+	var replies []func(traceroute.Attempt)
+	rtts := ms(10, 20, 30, 40)
+	for range rtts {
+		replies = append(replies, reordered.Aggregate(1))
+	}
+	for _, i := range []int{2, 0, 3, 1} {
+		replies[i](traceroute.Attempt{Outcome: traceroute.OutcomeReply, From: net.ParseIP("192.0.2.1"), RTT: rtts[i]})
+	}
+	require.Equal(t, rtts, reordered.Hops[0].Nodes[0].RTTs)
+	require.Equal(t, 10*time.Millisecond, reordered.Hops[0].Nodes[0].Stats().Jitter)
+	require.Equal(t, 10*time.Millisecond, reordered.Hops[0].Stats().Jitter)
+
+	result := traceroute.Result{DstIP: net.ParseIP("192.0.2.2"), Hops: []traceroute.Hop{hop}}
+	require.Equal(t, hop.Nodes[1].Stats(), result.Stats())
+	result.DstIP = net.ParseIP("198.51.100.1")
+	require.Equal(t, traceroute.RTTStats{}, result.Stats())
+}
@@ -0,0 +1,58 @@
+package traceroute
+
+import "net"
+
+// initialTTLs are the common initial TTLs of operating systems and routers,
+// e.g. 64 of Linux, 128 of Windows and 255 of most routers.
+var initialTTLs = [...]int{32, 64, 128, 255}
+
+// ReturnPath is the return path estimation of a node replied to a hop.
+type ReturnPath struct {
+	TTL int // TTL of the hop
+	IP  net.IP
+	// ReplyTTL is the greatest TTL of replies received from IP, InitialTTL
+	// is the guessed TTL they were sent with, which is the smallest common
+	// initial TTL not less than ReplyTTL.
+	ReplyTTL   int
+	InitialTTL int
+	// Hops is the estimated length of return path, counted like TTL so that
+	// it equals TTL if the return path is as long as the forward one.
+	Hops int
+	// Delta is Hops minus TTL.
+	Delta int
+	// Asymmetric reports whether the return path differs from the forward
+	// one by more than one hop, which is likely caused by asymmetric routing.
+	// One hop is tolerated for routers that reply with decremented TTL.
+	Asymmetric bool
+}
+
+// ReturnPaths estimates the return path length of every node which replied
+// with known TTL, it requires transport reporting the TTL of replies.
+func (r *Result) ReturnPaths() []ReturnPath {
+	var paths []ReturnPath
+	for _, hop := range r.Hops {
+		for _, node := range hop.Nodes {
+			replyTTL := 0
+			for _, attempt := range hop.Attempts {
+				if attempt.Outcome == OutcomeReply && attempt.From.Equal(node.IP) && attempt.ReplyTTL > replyTTL {
+					replyTTL = attempt.ReplyTTL
+				}
+			}
+			if replyTTL == 0 {
+				continue
+			}
+			path := ReturnPath{TTL: hop.TTL, IP: node.IP, ReplyTTL: replyTTL}
+			for _, initial := range initialTTLs {
+				if initial >= replyTTL {
+					path.InitialTTL = initial
+					break
+				}
+			}
+			path.Hops = path.InitialTTL - replyTTL + 1
+			path.Delta = path.Hops - hop.TTL
+			path.Asymmetric = path.Delta > 1 || path.Delta < -1
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
@@ -0,0 +1,120 @@
+package traceroute
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// RTTStats is the RTT statistics of replies to probes.
+type RTTStats struct {
+	Sent     int
+	Received int
+	// Loss is the percentage of probes not replied.
+	Loss   float64
+	Min    time.Duration
+	Max    time.Duration
+	Avg    time.Duration
+	Median time.Duration
+	StdDev time.Duration // population standard deviation
+	// Jitter is the mean absolute difference of the RTTs of consecutive
+	// probes, see Node.RTTs.
+	Jitter time.Duration
+}
+
+// Stats returns the RTT statistics of node. Sent is the number of probes to
+// the hop of node, so if other nodes replied the same hop (load balancing),
+// Loss includes the probes they replied. Use Hop.Stats for the loss of hop.
+func (n Node) Stats() RTTStats {
+	return rttStats(n.Sent, n.Received, n.RTTs)
+}
+
+// Stats returns the RTT statistics of all nodes replied to hop. Jitter is
+// measured within the RTT series of every node, since the RTT difference
+// between nodes isn't jitter.
+func (h Hop) Stats() RTTStats {
+	var rtts []time.Duration
+	var jitter time.Duration
+	var pairs int
+	for _, node := range h.Nodes {
+		rtts = append(rtts, node.RTTs...)
+		for i := 1; i < len(node.RTTs); i++ {
+			jitter += absDuration(node.RTTs[i] - node.RTTs[i-1])
+			pairs++
+		}
+	}
+	received := h.Received
+	if received == 0 { // hops built without counters
+		received = len(rtts)
+	}
+	stats := rttStats(h.Sent, received, rtts)
+	stats.Jitter = 0
+	if pairs > 0 {
+		stats.Jitter = jitter / time.Duration(pairs)
+	}
+	return stats
+}
+
+// Stats returns the end-to-end RTT statistics, that is the one of replies
+// from destination at the first hop it replied. It returns zero RTTStats if
+// destination isn't reached.
+func (r *Result) Stats() RTTStats {
+	for _, hop := range r.Hops {
+		for _, node := range hop.Nodes {
+			if node.IP.Equal(r.DstIP) {
+				return node.Stats()
+			}
+		}
+	}
+	return RTTStats{}
+}
+
+func rttStats(sent, received int, rtts []time.Duration) RTTStats {
+	stats := RTTStats{Sent: sent, Received: received}
+	if sent > 0 {
+		stats.Loss = float64(sent-received) * 100 / float64(sent)
+		if stats.Loss < 0 {
+			stats.Loss = 0
+		}
+	}
+	if len(rtts) == 0 {
+		return stats
+	}
+
+	sorted := append([]time.Duration(nil), rtts...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	stats.Min, stats.Max = sorted[0], sorted[len(sorted)-1]
+	if n := len(sorted); n%2 == 1 {
+		stats.Median = sorted[n/2]
+	} else {
+		stats.Median = (sorted[n/2-1] + sorted[n/2]) / 2
+	}
+
+	var sum time.Duration
+	for _, rtt := range rtts {
+		sum += rtt
+	}
+	stats.Avg = sum / time.Duration(len(rtts))
+	var variance float64
+	for _, rtt := range rtts {
+		d := float64(rtt - stats.Avg)
+		variance += d * d
+	}
+	stats.StdDev = time.Duration(math.Sqrt(variance / float64(len(rtts))))
+
+	if len(rtts) > 1 {
+		var jitter time.Duration
+		for i := 1; i < len(rtts); i++ {
+			jitter += absDuration(rtts[i] - rtts[i-1])
+		}
+		stats.Jitter = jitter / time.Duration(len(rtts)-1)
+	}
+	return stats
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
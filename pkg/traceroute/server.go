@@ -1,53 +1,113 @@
 package traceroute
 
 import (
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"net"
 	"sync"
 	"time"
 
+	netpacket "github.com/visonhuo/mykit/internal/net/packet"
 	"golang.org/x/net/context"
 	"golang.org/x/net/icmp"
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 type packet struct {
+	proto    int
 	bytes    []byte
 	size     int
 	addr     *net.IPAddr
 	recvTime time.Time
 	identify int
+	srcPort  int
+	dstPort  int
+	echoID   int
+	checksum int
+	ttl      int // TTL of reply packet
+	icmpType int
+	icmpCode int
+	mtu      int  // next-hop MTU of "fragmentation needed" and "packet too big"
+	quoted   bool // whether transport header of probe is quoted
+	// TTL of probe quoted by ICMP error when it arrived at the replying node
+	quotedTTL int
+	// ICMP extensions of reply
+	mpls       []MPLSLabel
+	interfaces []InterfaceInfo
+}
+
+// sessionID returns the identity of session which pkt replies to, that is
+// the echo identifier of ICMP probes, or the source port of UDP and TCP probes.
+func (p packet) sessionID() int {
+	if p.echoID != 0 {
+		return p.echoID
+	}
+	return p.srcPort
+}
+
+// isTooBig reports whether pkt is an ICMP "fragmentation needed" or ICMPv6
+// "packet too big" message.
+func (p packet) isTooBig() bool {
+	switch p.proto {
+	case protocolICMPv4:
+		return p.icmpType == int(ipv4.ICMPTypeDestinationUnreachable) && p.icmpCode == 4
+	case protocolICMPv6:
+		return p.icmpType == int(ipv6.ICMPTypePacketTooBig)
+	}
+	return false
+}
+
+// isPortUnreachable reports whether pkt is an ICMP port unreachable message,
+// which is replied by destination to UDP probes.
+func (p packet) isPortUnreachable() bool {
+	switch p.proto {
+	case protocolICMPv4:
+		return p.icmpType == int(ipv4.ICMPTypeDestinationUnreachable) && p.icmpCode == 3
+	case protocolICMPv6:
+		return p.icmpType == int(ipv6.ICMPTypeDestinationUnreachable) && p.icmpCode == 4
+	}
+	return false
 }
 
 type Server struct {
+	// stats is the first field for 64-bit alignment of its atomic counters
+	// on 32-bit platforms.
+	stats      stats
 	config     Config
-	rConn      net.PacketConn
-	wConn      *ipv4.RawConn
+	transport  Transport
 	packetQ    chan packet
 	close      chan struct{}
 	shutdown   sync.Once
-	ip2Session sync.Map
+	sessions   sync.Map // session id -> *session
+	coalesceMu sync.Mutex
+	coalesced  map[coalesceKey]*session
 	bufPool    sync.Pool
+	names      *nameCache
+	lookupSem  chan struct{}
 }
 
 func NewServer(cfg Config) (*Server, error) {
 	cfg.init()
 	srv := &Server{
-		config:     cfg,
-		packetQ:    make(chan packet, cfg.PacketQueueSize),
-		close:      make(chan struct{}),
-		ip2Session: sync.Map{},
+		config:    cfg,
+		packetQ:   make(chan packet, cfg.PacketQueueSize),
+		close:     make(chan struct{}),
+		coalesced: make(map[coalesceKey]*session),
+		names:     newNameCache(cfg.NameCacheTTL),
+		lookupSem: make(chan struct{}, cfg.MaxConcurrentLookups),
 		bufPool: sync.Pool{New: func() interface{} {
 			return make([]byte, 1500)
 		}},
 	}
-	for _, fn := range []func() error{
-		srv.setupReadConn,
-		srv.setupWriteConn,
-	} {
-		if err := fn(); err != nil {
-			_ = srv.Shutdown()
+	srv.transport = cfg.Transport
+	if srv.transport == nil {
+		transport, err := NewRawTransport(cfg.Network, cfg.LocalSrcIP)
+		if err != nil {
 			return nil, err
 		}
+		srv.transport = transport
 	}
 
 	go srv.server()
@@ -55,44 +115,30 @@ func NewServer(cfg Config) (*Server, error) {
 	return srv, nil
 }
 
-func (s *Server) setupReadConn() error {
-	conn, err := icmp.ListenPacket("ip4:icmp", net.IPv4zero.String())
-	if err != nil {
-		return err
-	}
-	s.rConn = conn
-	return nil
-}
-
-func (s *Server) setupWriteConn() error {
-	udpConn, err := net.ListenPacket("ip4:udp", s.config.LocalSrcIP.String())
-	if err != nil {
-		return err
-	}
-	rawConn, err := ipv4.NewRawConn(udpConn)
-	if err != nil {
-		return err
-	}
-	s.wConn = rawConn
-	return nil
-}
-
 func (s *Server) server() {
 	for {
 		buf := s.bufPool.Get().([]byte)
-		n, addr, err := s.rConn.ReadFrom(buf)
+		reply, err := s.transport.Recv(buf)
 		if err != nil {
 			_ = s.Shutdown()
 			return
 		}
-		if n <= 0 {
+		if reply.N <= 0 {
+			s.bufPool.Put(buf)
 			continue
 		}
 
 		select {
 		case <-s.close:
 			return
-		case s.packetQ <- packet{bytes: buf, size: n, addr: addr.(*net.IPAddr), recvTime: time.Now()}:
+		case s.packetQ <- packet{
+			proto:    reply.Protocol,
+			bytes:    buf,
+			size:     reply.N,
+			addr:     &net.IPAddr{IP: reply.From},
+			recvTime: reply.RecvTime,
+			ttl:      reply.TTL,
+		}:
 		}
 	}
 }
@@ -108,76 +154,327 @@ func (s *Server) dispatch() {
 				return
 			}
 
-			msg, err := icmp.ParseMessage(protocolICMPv4, pkt.bytes[:pkt.size])
-			s.bufPool.Put(pkt.bytes)
-			pkt.bytes = nil
-			if err != nil {
-				s.logf("Parse ICMPv4 message failed(len=%d, from=%v):%v", len(pkt.bytes), pkt.addr, err)
-				continue
-			}
+			s.dispatchPacket(pkt)
+		}
+	}
+}
 
-			var originData []byte
-			switch body := msg.Body.(type) {
-			case *icmp.TimeExceeded:
-				originData = body.Data
-			case *icmp.DstUnreach:
-				originData = body.Data
-			default:
-				continue
-			}
-			if len(originData) < ipv4.HeaderLen || originData[0]>>4 != ipv4.Version {
-				s.logf("Invalid IP header from %v:%v", pkt.addr, originData)
-				continue
-			}
-			originHeader, err := ipv4.ParseHeader(originData)
-			if err != nil {
-				s.logf("Parse IP header failed(%v): %v", originData, err)
-				continue
-			}
+// dispatchPacket dispatches pkt to its session, a packet crashing the parser
+// is counted as malformed rather than stopping the dispatcher.
+func (s *Server) dispatchPacket(pkt packet) {
+	defer func() {
+		if e := recover(); e != nil {
+			s.stats.inc(&s.stats.malformed)
+			s.logf("Dispatch packet from %v panic: %v", pkt.addr, e)
+		}
+	}()
+
+	if pkt.proto == protocolTCP {
+		s.dispatchTCP(pkt)
+	} else {
+		s.stats.inc(&s.stats.received)
+		s.dispatchICMP(pkt)
+	}
+}
+
+func (s *Server) dispatchICMP(pkt packet) {
+	msg, err := icmp.ParseMessage(pkt.proto, pkt.bytes[:pkt.size])
+	if err == nil && pkt.proto == protocolICMPv4 && msg.Type == ipv4.ICMPTypeDestinationUnreachable &&
+		msg.Code == 4 && pkt.size >= 8 {
+		// next-hop MTU of fragmentation needed message (RFC 1191)
+		pkt.mtu = int(binary.BigEndian.Uint16(pkt.bytes[6:8]))
+	}
+	s.bufPool.Put(pkt.bytes)
+	pkt.bytes = nil
+	if err != nil {
+		s.stats.inc(&s.stats.malformed)
+		s.logf("Parse ICMP message failed(len=%d, from=%v):%v", pkt.size, pkt.addr, err)
+		return
+	}
+
+	pkt.icmpType, pkt.icmpCode = icmpTypeNumber(msg.Type), msg.Code
+	var originData []byte
+	switch body := msg.Body.(type) {
+	case *icmp.TimeExceeded:
+		originData = body.Data
+		pkt.mpls, pkt.interfaces = parseExtensions(body.Extensions)
+	case *icmp.DstUnreach:
+		originData = body.Data
+		pkt.mpls, pkt.interfaces = parseExtensions(body.Extensions)
+	case *icmp.PacketTooBig:
+		originData = body.Data
+		pkt.mtu = body.MTU
+	case *icmp.Echo:
+		if msg.Type != ipv4.ICMPTypeEchoReply && msg.Type != ipv6.ICMPTypeEchoReply {
+			s.stats.inc(&s.stats.unknown)
+			return
+		}
+		// Echo reply comes from the destination itself, and quotes nothing.
+		pkt.identify = body.Seq
+		pkt.echoID = body.ID
+		s.deliver(pkt.addr.IP, pkt)
+		return
+	default:
+		s.stats.inc(&s.stats.unknown)
+		return
+	}
+
+	dst, err := s.parseOrigin(&pkt, originData)
+	if err != nil {
+		s.stats.inc(&s.stats.malformed)
+		s.logf("Parse origin datagram from %v failed: %v", pkt.addr, err)
+		return
+	}
+	s.deliver(dst, pkt)
+}
+
+func (s *Server) dispatchTCP(pkt packet) {
+	var tcp netpacket.TCPv4
+	err := tcp.Unmarshal(pkt.bytes[:pkt.size])
+	s.bufPool.Put(pkt.bytes)
+	pkt.bytes = nil
+	// Raw TCP socket receives a copy of all TCP traffic on host, which is
+	// dropped before counting. Only SYN-ACK or RST answered to our SYN probe
+	// is interesting, which is sent from the destination to the source port
+	// of a session, and acknowledges the probe sequence number.
+	if err != nil || !s.isSessionPort(int(tcp.DstPort), pkt.addr.IP) {
+		return
+	}
+	if !tcp.HasFlags(netpacket.TCPFlagSYN|netpacket.TCPFlagACK) && !tcp.HasFlags(netpacket.TCPFlagRST) {
+		return
+	}
+	s.stats.inc(&s.stats.received)
+	pkt.identify = int(tcp.Ack - 1)
+	pkt.srcPort = int(tcp.DstPort)
+	pkt.dstPort = int(tcp.SrcPort)
+	s.deliver(pkt.addr.IP, pkt)
+}
+
+func (s *Server) deliver(dst net.IP, pkt packet) {
+	var sess *session
+	if id := pkt.sessionID(); id != 0 {
+		value, _ := s.sessions.Load(id)
+		sess, _ = value.(*session)
+	} else {
+		sess = s.lookupSession(dst)
+	}
+	if sess == nil || !sess.dstIP.Equal(dst) {
+		s.stats.inc(&s.stats.unknown)
+		return
+	}
+	sess.acceptPacket(pkt)
+}
 
-			pkt.bytes = nil
-			pkt.identify = originHeader.ID
-			value, _ := s.ip2Session.Load(originHeader.Dst.String())
-			value.(*session).acceptPacket(pkt)
+// isSessionPort reports whether port is the source port of a running session
+// to dst.
+func (s *Server) isSessionPort(port int, dst net.IP) bool {
+	value, ok := s.sessions.Load(port)
+	return ok && value.(*session).dstIP.Equal(dst)
+}
+
+// lookupSession returns the only session to dst, it returns nil if there are
+// none or more than one.
+func (s *Server) lookupSession(dst net.IP) *session {
+	var found *session
+	var count int
+	s.sessions.Range(func(_, value interface{}) bool {
+		if sess := value.(*session); sess.dstIP.Equal(dst) {
+			found = sess
+			count++
 		}
+		return count < 2
+	})
+	if count != 1 {
+		return nil
 	}
+	return found
+}
+
+// parseOrigin matches pkt with the probe quoted in originData. Probes are
+// identified by the quoted transport header, which survives NAT and routers
+// rewriting IP ID: the sequence of ICMP echo and TCP SYN probes, or the ports
+// and checksum of UDP probes. IP ID is used only if the transport header isn't
+// quoted.
+func (s *Server) parseOrigin(pkt *packet, originData []byte) (net.IP, error) {
+	quote, err := netpacket.ParseQuote(originData)
+	if err != nil {
+		return nil, err
+	}
+	pkt.identify = quote.ID
+	pkt.quotedTTL = quote.TTL
+	pkt.quoted = quote.Transport
+	if !quote.Transport {
+		return quote.Dst, nil
+	}
+	switch quote.Protocol {
+	case protocolICMPv4, protocolICMPv6:
+		pkt.echoID = int(quote.EchoID)
+		pkt.identify = int(quote.EchoSeq)
+	case protocolUDP:
+		pkt.srcPort = int(quote.SrcPort)
+		pkt.dstPort = int(quote.DstPort)
+		pkt.checksum = int(quote.Checksum)
+	case protocolTCP:
+		pkt.srcPort = int(quote.SrcPort)
+		pkt.dstPort = int(quote.DstPort)
+		pkt.identify = int(quote.Seq)
+	}
+	return quote.Dst, nil
 }
 
 func (s *Server) write(header ipv4.Header, payload []byte) error {
-	return s.wConn.WriteTo(&header, payload, nil)
+	return s.transport.Send(Probe{
+		Protocol:     header.Protocol,
+		Src:          header.Src,
+		Dst:          header.Dst,
+		TTL:          header.TTL,
+		ID:           header.ID,
+		DontFragment: header.Flags&ipv4.DontFragment != 0,
+		Payload:      payload,
+	})
+}
+
+func (s *Server) write6(header ipv6.Header, payload []byte) error {
+	return s.transport.Send(Probe{
+		Protocol: header.NextHeader,
+		Src:      header.Src,
+		Dst:      header.Dst,
+		TTL:      header.HopLimit,
+		Payload:  payload,
+	})
+}
+
+func (s *Server) isIPv6() bool {
+	return s.config.Network == NetworkIPv6
 }
 
 func (s *Server) Traceroute(ctx context.Context, target string, opts Options) (*Future, error) {
-	ipAddr, err := net.ResolveIPAddr("ip4", target)
+	if opts.Protocol == ProtocolTCP {
+		if s.isIPv6() {
+			return nil, errors.New("tcp probe is only supported over ipv4")
+		}
+		if opts.Multipath {
+			return nil, errors.New("tcp probe doesn't support multipath detection")
+		}
+		if opts.PMTU {
+			return nil, errors.New("tcp probe doesn't support path mtu discovery")
+		}
+	}
+	if opts.Multipath && opts.PMTU {
+		return nil, errors.New("multipath detection doesn't support path mtu discovery")
+	}
+	if (opts.Paris || opts.Multipath) && opts.PacketSize > 0 && opts.PacketSize < minParisPacketSize {
+		return nil, fmt.Errorf("packet size of paris probe must be at least %d", minParisPacketSize)
+	}
+	ipAddr, err := net.ResolveIPAddr(s.config.Network, target)
 	if err != nil {
 		return nil, err
 	}
 
-	newSession := session{
-		ctx:    ctx,
-		server: s,
-		dstIP:  ipAddr.IP,
-	}
-	value, loaded := s.ip2Session.LoadOrStore(ipAddr.IP.String(), &newSession)
-	if loaded {
-		return value.(*session).future, nil
+	opts.init()
+	key := coalesceKey{dst: ipAddr.IP.String(), opts: opts}
+	if opts.Coalesce {
+		s.coalesceMu.Lock()
+		defer s.coalesceMu.Unlock()
+		if sess, ok := s.coalesced[key]; ok {
+			s.join(ctx, key, sess)
+			return sess.future, nil
+		}
 	}
 
-	_ = newSession.init()
+	sessCtx, cancel := ctx, context.CancelFunc(nil)
+	if opts.Coalesce {
+		// coalesced session outlives the caller starting it, see join.
+		sessCtx, cancel = context.WithCancel(context.Background())
+	}
+	newSession, err := s.register(sessCtx, ipAddr.IP)
+	if err != nil {
+		if cancel != nil {
+			cancel()
+		}
+		return nil, err
+	}
+	if opts.Coalesce {
+		newSession.cancel = cancel
+		s.coalesced[key] = newSession
+		s.join(ctx, key, newSession)
+	}
 	go newSession.run(opts)
 	return newSession.future, nil
 }
 
+// join adds the caller of ctx to the coalesced session sess, which is
+// cancelled once all of its callers cancel. It must be called with coalesceMu
+// held.
+func (s *Server) join(ctx context.Context, key coalesceKey, sess *session) {
+	sess.callers++
+	go func() {
+		select {
+		case <-sess.future.finish:
+			return
+		case <-ctx.Done():
+		}
+		s.coalesceMu.Lock()
+		defer s.coalesceMu.Unlock()
+		sess.callers--
+		if sess.callers == 0 {
+			// cancelled session isn't shared with new callers any more
+			if s.coalesced[key] == sess {
+				delete(s.coalesced, key)
+			}
+			sess.cancel()
+		}
+	}()
+}
+
+// coalesceKey identifies the sessions which can be shared by callers.
+type coalesceKey struct {
+	dst  string
+	opts Options
+}
+
+// register creates a session to dst with a unique session id, which
+// demultiplexes replies to it.
+func (s *Server) register(ctx context.Context, dst net.IP) (*session, error) {
+	for i := 0; i < maxRegisterAttempts; i++ {
+		newSession := &session{
+			ctx:    ctx,
+			server: s,
+			dstIP:  dst,
+		}
+		_ = newSession.init()
+		if _, loaded := s.sessions.LoadOrStore(newSession.srcPort, newSession); !loaded {
+			return newSession, nil
+		}
+	}
+	return nil, errors.New("too many sessions")
+}
+
+// unregister removes the finished session, so that replies to it are dropped.
+func (s *Server) unregister(sess *session, opts Options) {
+	s.sessions.Delete(sess.srcPort)
+	if opts.Coalesce {
+		sess.cancel()
+		s.coalesceMu.Lock()
+		key := coalesceKey{dst: sess.dstIP.String(), opts: opts}
+		if s.coalesced[key] == sess {
+			delete(s.coalesced, key)
+		}
+		s.coalesceMu.Unlock()
+	}
+}
+
+// Stats returns a snapshot of the packet counters of Server.
+func (s *Server) Stats() Stats {
+	return s.stats.snapshot()
+}
+
 func (s *Server) Shutdown() error {
 	var firstErr error
 	s.shutdown.Do(func() {
 		close(s.close)
-		close(s.packetQ)
-		if err := s.rConn.Close(); err != nil {
-			firstErr = err
-		}
-		if err := s.wConn.Close(); err != nil && firstErr == nil {
-			firstErr = err
+		if s.transport != nil {
+			firstErr = s.transport.Close()
 		}
 	})
 	return firstErr
@@ -2,21 +2,842 @@ package traceroute_test
 
 import (
 	"context"
-	"fmt"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	netpacket "github.com/visonhuo/mykit/internal/net/packet"
 	"github.com/visonhuo/mykit/pkg/traceroute"
+	"github.com/visonhuo/mykit/pkg/traceroute/traceroutetest"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
 )
 
 func TestServer(t *testing.T) {
-	srv, err := traceroute.NewServer(traceroute.Config{})
+	srv, err := traceroute.NewServer(traceroute.Config{LocalSrcIP: net.ParseIP(simSrc), Transport: newSimulator()})
 	require.NoError(t, err)
+	defer srv.Shutdown()
 
-	host := "www.google.com"
-	future, err := srv.Traceroute(context.Background(), host, traceroute.Options{})
+	future, err := srv.Traceroute(context.Background(), simDst, traceroute.Options{})
 	require.NoError(t, err)
 	require.NoError(t, future.Error())
 	result := future.Result()
-	fmt.Println(result)
+	require.True(t, result.Reach)
+	require.Len(t, result.Hops, 4)
+}
+
+func TestServer_Simulator(t *testing.T) {
+	for name, fn := range map[string]func(t *testing.T){
+		"linear":     testSimulatorLinear,
+		"protocols":  testSimulatorProtocols,
+		"ecmp":       testSimulatorECMP,
+		"silentHop":  testSimulatorSilentHop,
+		"loss":       testSimulatorLoss,
+		"multipath":  testSimulatorMultipath,
+		"subscribe":  testSimulatorSubscribe,
+		"stopEarly":  testSimulatorStopEarly,
+		"concurrent": testSimulatorConcurrent,
+		"nat":        testSimulatorNAT,
+		"stats":      testSimulatorStats,
+		"names":      testSimulatorNames,
+		"namesDedup": testSimulatorNamesDedup,
+		"extensions": testSimulatorExtensions,
+		"prohibited": testSimulatorProhibited,
+		"monitor":    testSimulatorMonitor,
+		"pmtu":       testSimulatorPMTU,
+		"ipv6":       testSimulatorIPv6,
+	} {
+		t.Run(name, fn)
+	}
+}
+
+const (
+	simSrc = "192.0.2.1"
+	simDst = "198.51.100.1"
+)
+
+// newSimulator returns a network of src - 10.0.0.1 - (10.0.1.1 | 10.0.1.2) -
+// 10.0.2.1 - dst, where 10.0.0.1 balances load between two routers.
+func newSimulator() *traceroutetest.Network {
+	network := traceroutetest.NewNetwork(simSrc, 1)
+	for _, ip := range []string{"10.0.0.1", "10.0.1.1", "10.0.1.2", "10.0.2.1"} {
+		network.AddRouter(ip)
+	}
+	network.AddHost(simDst).OpenPorts = []int{443}
+	network.Chain(time.Millisecond, simSrc, "10.0.0.1", "10.0.1.1", "10.0.2.1", simDst)
+	network.Chain(time.Millisecond, "10.0.0.1", "10.0.1.2", "10.0.2.1")
+	return network
+}
+
+func simulate(t *testing.T, transport traceroute.Transport, opts traceroute.Options) traceroute.Result {
+	srv, err := traceroute.NewServer(traceroute.Config{LocalSrcIP: net.ParseIP(simSrc), Transport: transport})
+	require.NoError(t, err)
+	defer srv.Shutdown()
+
+	future, err := srv.Traceroute(context.Background(), simDst, opts)
+	require.NoError(t, err)
+	require.NoError(t, future.Error())
+	result := future.Result()
+	sort.Slice(result.Hops, func(i, j int) bool {
+		return result.Hops[i].TTL < result.Hops[j].TTL
+	})
+	return result
+}
+
+// countTransport counts the probes sent through Transport.
+type countTransport struct {
+	traceroute.Transport
+	sent int64
+}
+
+func (t *countTransport) Send(probe traceroute.Probe) error {
+	atomic.AddInt64(&t.sent, 1)
+	return t.Transport.Send(probe)
+}
+
+func hopIPs(hop traceroute.Hop) []string {
+	ips := make([]string, 0, len(hop.Nodes))
+	for _, node := range hop.Nodes {
+		ips = append(ips, node.IP.String())
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+func testSimulatorLinear(t *testing.T) {
+	network := traceroutetest.NewNetwork(simSrc, 1)
+	network.AddRouter("10.0.0.1")
+	network.AddRouter("10.0.1.1")
+	network.AddHost(simDst)
+	network.Chain(time.Millisecond, simSrc, "10.0.0.1", "10.0.1.1", simDst)
+
+	result := simulate(t, network, traceroute.Options{MaxHop: 3, Timeout: 100 * time.Millisecond})
+	require.True(t, result.Reach)
+	require.Len(t, result.Hops, 3)
+	for i, ip := range []string{"10.0.0.1", "10.0.1.1", simDst} {
+		require.Equal(t, i+1, result.Hops[i].TTL)
+		require.Equal(t, []string{ip}, hopIPs(result.Hops[i]))
+		require.Len(t, result.Hops[i].Nodes[0].RTTs, 3)
+		for _, rtt := range result.Hops[i].Nodes[0].RTTs {
+			require.GreaterOrEqual(t, rtt, time.Duration(2*(i+1))*time.Millisecond)
+		}
+		for _, attempt := range result.Hops[i].Attempts {
+			require.Equal(t, 64-i, attempt.ReplyTTL)
+			require.Equal(t, 1, attempt.QuotedTTL)
+			require.Empty(t, attempt.Annotation())
+		}
+	}
+	for _, path := range result.ReturnPaths() {
+		require.Equal(t, path.TTL, path.Hops)
+		require.False(t, path.Asymmetric)
+	}
+	require.Equal(t, 11, result.Hops[0].Attempts[0].ICMPType) // time exceeded
+	require.Equal(t, 3, result.Hops[2].Attempts[0].ICMPType)  // port unreachable
+	require.Equal(t, 3, result.Hops[2].Attempts[0].ICMPCode)
+}
+
+func testSimulatorProtocols(t *testing.T) {
+	for _, opts := range []traceroute.Options{
+		{Protocol: traceroute.ProtocolUDP},
+		{Protocol: traceroute.ProtocolICMP},
+		{Protocol: traceroute.ProtocolTCP, Port: 443},
+		{Protocol: traceroute.ProtocolTCP, Port: 80},
+		{Protocol: traceroute.ProtocolUDP, Paris: true},
+		{Protocol: traceroute.ProtocolICMP, Paris: true},
+	} {
+		opts.MaxHop, opts.Timeout = 4, 100*time.Millisecond
+		result := simulate(t, newSimulator(), opts)
+		require.True(t, result.Reach, "%+v", opts)
+		require.Len(t, result.Hops, 4, "%+v", opts)
+		require.Equal(t, []string{simDst}, hopIPs(result.Hops[3]), "%+v", opts)
+	}
+}
+
+func testSimulatorIPv6(t *testing.T) {
+	const src, dst = "2001:db8::1", "2001:db8:ff::1"
+	for _, opts := range []traceroute.Options{
+		{Protocol: traceroute.ProtocolUDP},
+		{Protocol: traceroute.ProtocolICMP},
+	} {
+		network := traceroutetest.NewNetwork(src, 1)
+		network.AddRouter("2001:db8:1::1")
+		network.AddRouter("2001:db8:2::1")
+		network.AddHost(dst)
+		network.Chain(time.Millisecond, src, "2001:db8:1::1", "2001:db8:2::1", dst)
+
+		srv, err := traceroute.NewServer(traceroute.Config{
+			Network:    traceroute.NetworkIPv6,
+			LocalSrcIP: net.ParseIP(src),
+			Transport:  network,
+		})
+		require.NoError(t, err)
+		opts.MaxHop, opts.Timeout = 3, 100*time.Millisecond
+		future, err := srv.Traceroute(context.Background(), dst, opts)
+		require.NoError(t, err)
+		require.NoError(t, future.Error())
+		result := future.Result()
+		_ = srv.Shutdown()
+		sort.Slice(result.Hops, func(i, j int) bool {
+			return result.Hops[i].TTL < result.Hops[j].TTL
+		})
+
+		require.True(t, result.Reach, "%+v", opts)
+		require.Len(t, result.Hops, 3, "%+v", opts)
+		for i, ip := range []string{"2001:db8:1::1", "2001:db8:2::1", dst} {
+			require.Equal(t, []string{ip}, hopIPs(result.Hops[i]), "%+v", opts)
+		}
+	}
+}
+
+func testSimulatorECMP(t *testing.T) {
+	// Classic probes change destination port, so they are balanced onto both
+	// paths, while Paris probes always follow the same one.
+	opts := traceroute.Options{MaxHop: 4, Attempts: 16, Timeout: 100 * time.Millisecond}
+	result := simulate(t, newSimulator(), opts)
+	require.Equal(t, []string{"10.0.1.1", "10.0.1.2"}, hopIPs(result.Hops[1]))
+	for _, node := range result.Hops[1].Nodes { // partial replies of the hop
+		require.Equal(t, 16, node.Sent)
+		require.Less(t, node.Received, 16)
+	}
+	require.Equal(t, 16, result.Hops[1].Received)
+
+	opts.Paris = true
+	result = simulate(t, newSimulator(), opts)
+	for _, hop := range result.Hops {
+		require.Len(t, hop.Nodes, 1)
+		require.Len(t, hop.Nodes[0].RTTs, 16)
+	}
+}
+
+func testSimulatorSilentHop(t *testing.T) {
+	network := newSimulator()
+	network.AddRouter("10.0.2.1").Silent = true
+
+	result := simulate(t, network, traceroute.Options{MaxHop: 4, Timeout: 100 * time.Millisecond})
+	require.True(t, result.Reach)
+	require.Len(t, result.Hops, 4)
+	for i, hop := range result.Hops {
+		require.Equal(t, i+1, hop.TTL)
+		require.Equal(t, 3, hop.Sent)
+		require.Len(t, hop.Attempts, 3)
+	}
+	silent := result.Hops[2]
+	require.Empty(t, silent.Nodes)
+	require.Equal(t, 0, silent.Received)
+	for _, attempt := range silent.Attempts {
+		require.Equal(t, traceroute.OutcomeTimeout, attempt.Outcome)
+	}
+	for _, attempt := range result.Hops[3].Attempts {
+		require.Equal(t, traceroute.OutcomeReply, attempt.Outcome)
+		require.Equal(t, simDst, attempt.From.String())
+	}
+	require.Equal(t, 3, result.Hops[3].Nodes[0].Sent)
+	require.Equal(t, 3, result.Hops[3].Nodes[0].Received)
+}
+
+func testSimulatorLoss(t *testing.T) {
+	network := newSimulator()
+	network.Connect("10.0.2.1", simDst, time.Millisecond).Loss = 1
+
+	start := time.Now()
+	result := simulate(t, network, traceroute.Options{MaxHop: 4, Timeout: 100 * time.Millisecond})
+	require.False(t, result.Reach)
+	require.Len(t, result.Hops, 4)
+	require.Equal(t, 3, result.Hops[2].Received)
+	require.Equal(t, 0, result.Hops[3].Received)
+	require.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+}
+
+func testSimulatorMultipath(t *testing.T) {
+	opts := traceroute.Options{Multipath: true, MaxHop: 8, Timeout: 100 * time.Millisecond}
+	result := simulate(t, newSimulator(), opts)
+	require.True(t, result.Reach)
+	require.NotNil(t, result.Graph)
+
+	var ttl2 []string
+	for _, iface := range result.Graph.Interfaces {
+		if iface.TTL == 2 {
+			ttl2 = append(ttl2, iface.IP.String())
+		}
+	}
+	require.Equal(t, []string{"10.0.1.1", "10.0.1.2"}, ttl2)
+
+	links := make(map[string]int)
+	for _, link := range result.Graph.Links {
+		links[link.From.String()+"-"+link.To.String()] = len(link.FlowIDs)
+	}
+	for _, key := range []string{
+		simSrc + "-10.0.0.1",
+		"10.0.0.1-10.0.1.1", "10.0.0.1-10.0.1.2",
+		"10.0.1.1-10.0.2.1", "10.0.1.2-10.0.2.1",
+		"10.0.2.1-" + simDst,
+	} {
+		require.Greater(t, links[key], 0, key)
+	}
+	require.Len(t, links, 6)
+}
+
+func testSimulatorSubscribe(t *testing.T) {
+	network := traceroutetest.NewNetwork(simSrc, 1)
+	network.AddRouter("10.0.0.1")
+	network.AddHost(simDst)
+	network.Chain(time.Millisecond, simSrc, "10.0.0.1", simDst)
+
+	srv, err := traceroute.NewServer(traceroute.Config{LocalSrcIP: net.ParseIP(simSrc), Transport: network})
+	require.NoError(t, err)
+	defer srv.Shutdown()
+
+	future, err := srv.Traceroute(context.Background(), simDst, traceroute.Options{MaxHop: 2, Timeout: 100 * time.Millisecond})
+	require.NoError(t, err)
+
+	var events []traceroute.Event
+	for event := range future.Subscribe() {
+		events = append(events, event)
+	}
+	require.Len(t, events, 7)
+	for _, event := range events[:6] {
+		require.False(t, event.Done)
+		require.Equal(t, []string{"10.0.0.1", simDst}[event.TTL-1], event.IP.String())
+		require.Greater(t, event.RTT, time.Duration(0))
+	}
+	last := events[6]
+	require.True(t, last.Done)
+	require.NoError(t, last.Err)
+	require.Equal(t, future.Result(), last.Result)
+
+	// subscribing after finished replays all events
+	var replayed []traceroute.Event
+	for event := range future.Subscribe() {
+		replayed = append(replayed, event)
+	}
+	require.Equal(t, events, replayed)
+}
+
+func testSimulatorStopEarly(t *testing.T) {
+	for _, opts := range []traceroute.Options{
+		{Protocol: traceroute.ProtocolUDP},
+		{Protocol: traceroute.ProtocolICMP},
+		{Protocol: traceroute.ProtocolTCP, Port: 443},
+	} {
+		opts.Window, opts.Timeout = 2, 100*time.Millisecond
+		transport := &countTransport{Transport: newSimulator()}
+		result := simulate(t, transport, opts)
+		require.True(t, result.Reach, "%+v", opts)
+		require.Len(t, result.Hops, 4, "%+v", opts)
+		require.Equal(t, []string{simDst}, hopIPs(result.Hops[3]), "%+v", opts)
+		// destination is 4 hops away, at most a window of TTLs beyond it is probed
+		require.LessOrEqual(t, atomic.LoadInt64(&transport.sent), int64((4+opts.Window)*3), "%+v", opts)
+	}
+}
+
+func testSimulatorConcurrent(t *testing.T) {
+	srv, err := traceroute.NewServer(traceroute.Config{LocalSrcIP: net.ParseIP(simSrc), Transport: newSimulator()})
+	require.NoError(t, err)
+	defer srv.Shutdown()
+
+	ctx := context.Background()
+	allOpts := []traceroute.Options{
+		{Protocol: traceroute.ProtocolUDP, MaxHop: 2},
+		{Protocol: traceroute.ProtocolICMP},
+		{Protocol: traceroute.ProtocolTCP, Port: 443},
+		{Protocol: traceroute.ProtocolUDP, Paris: true},
+	}
+	futures := make([]*traceroute.Future, 0, len(allOpts))
+	for _, opts := range allOpts {
+		opts.Timeout = 100 * time.Millisecond
+		future, err := srv.Traceroute(ctx, simDst, opts)
+		require.NoError(t, err)
+		futures = append(futures, future)
+	}
+	for i, future := range futures {
+		require.NoError(t, future.Error())
+		result := future.Result()
+		require.Equal(t, allOpts[i].Protocol, result.Opts.Protocol)
+		if i == 0 {
+			require.False(t, result.Reach)
+			require.Len(t, result.Hops, 2)
+		} else {
+			require.True(t, result.Reach, "%+v", allOpts[i])
+			require.Len(t, result.Hops, 4, "%+v", allOpts[i])
+		}
+		for _, hop := range result.Hops {
+			require.Equal(t, 3, hop.Received, "%+v", allOpts[i])
+		}
+	}
+
+	// finished session is removed, so the destination can be traced again
+	future, err := srv.Traceroute(ctx, simDst, traceroute.Options{Timeout: 100 * time.Millisecond})
+	require.NoError(t, err)
+	require.NoError(t, future.Error())
+	require.True(t, future.Result().Reach)
+
+	// only sessions with equal options are coalesced
+	opts := traceroute.Options{Timeout: 100 * time.Millisecond, Coalesce: true}
+	first, err := srv.Traceroute(ctx, simDst, opts)
+	require.NoError(t, err)
+	second, err := srv.Traceroute(ctx, simDst, opts)
+	require.NoError(t, err)
+	require.Same(t, first, second)
+	opts.Protocol = traceroute.ProtocolICMP
+	third, err := srv.Traceroute(ctx, simDst, opts)
+	require.NoError(t, err)
+	require.NotSame(t, first, third)
+	require.NoError(t, first.Error())
+	require.NoError(t, third.Error())
+}
+
+func testSimulatorNAT(t *testing.T) {
+	// NAT rewrites IP ID of probes, replies beyond it are still matched by
+	// the quoted transport header.
+	for _, opts := range []traceroute.Options{
+		{Protocol: traceroute.ProtocolUDP},
+		{Protocol: traceroute.ProtocolICMP},
+		{Protocol: traceroute.ProtocolTCP, Port: 443},
+		{Protocol: traceroute.ProtocolUDP, Paris: true},
+	} {
+		network := newSimulator()
+		router := network.AddRouter("10.0.0.1")
+		router.NAT, router.NATAddr = true, net.ParseIP("203.0.113.1")
+
+		opts.Timeout = 100 * time.Millisecond
+		result := simulate(t, network, opts)
+		require.True(t, result.Reach, "%+v", opts)
+		require.Len(t, result.Hops, 4, "%+v", opts)
+		for _, hop := range result.Hops {
+			require.Equal(t, 3, hop.Received, "%+v", opts)
+		}
+	}
+}
+
+// noisyTransport injects stray packets, and duplicates every reply of the
+// underlying Transport. Recv is only called by the receiving goroutine of
+// Server, so no lock is needed.
+type noisyTransport struct {
+	traceroute.Transport
+	pending []noisyPacket
+}
+
+type noisyPacket struct {
+	reply traceroute.Reply
+	bytes []byte
+}
+
+func (t *noisyTransport) inject(t2 *testing.T, from string, msg icmp.Message) {
+	b, err := msg.Marshal(nil)
+	require.NoError(t2, err)
+	t.pending = append(t.pending, noisyPacket{
+		reply: traceroute.Reply{Protocol: 1, From: net.ParseIP(from), RecvTime: time.Now()},
+		bytes: b,
+	})
+}
+
+func (t *noisyTransport) Recv(b []byte) (traceroute.Reply, error) {
+	if len(t.pending) > 0 {
+		pkt := t.pending[0]
+		t.pending = t.pending[1:]
+		pkt.reply.N = copy(b, pkt.bytes)
+		return pkt.reply, nil
+	}
+	reply, err := t.Transport.Recv(b)
+	if err == nil {
+		t.pending = append(t.pending, noisyPacket{reply: reply, bytes: append([]byte(nil), b[:reply.N]...)})
+	}
+	return reply, err
+}
+
+func testSimulatorStats(t *testing.T) {
+	transport := &noisyTransport{Transport: newSimulator()}
+	// malformed packet
+	transport.pending = append(transport.pending, noisyPacket{
+		reply: traceroute.Reply{Protocol: 1, From: net.ParseIP("8.8.8.8")},
+		bytes: []byte{11},
+	})
+	// echo reply and echo request to nobody
+	transport.inject(t, "8.8.8.8", icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: &icmp.Echo{ID: 1, Seq: 1}})
+	transport.inject(t, "8.8.8.8", icmp.Message{Type: ipv4.ICMPTypeEcho, Body: &icmp.Echo{ID: 1, Seq: 1}})
+	// time exceeded of unknown destination
+	quote := make([]byte, ipv4.HeaderLen+8)
+	quote[0], quote[9] = 0x45, 17
+	copy(quote[16:20], net.ParseIP("8.8.8.8").To4())
+	transport.inject(t, "10.0.0.1", icmp.Message{Type: ipv4.ICMPTypeTimeExceeded, Body: &icmp.TimeExceeded{Data: quote}})
+
+	srv, err := traceroute.NewServer(traceroute.Config{LocalSrcIP: net.ParseIP(simSrc), Transport: transport})
+	require.NoError(t, err)
+	defer srv.Shutdown()
+	future, err := srv.Traceroute(context.Background(), simDst, traceroute.Options{MaxHop: 4, Timeout: 100 * time.Millisecond})
+	require.NoError(t, err)
+	require.NoError(t, future.Error())
+	for _, hop := range future.Result().Hops {
+		require.Equal(t, 3, hop.Received)
+	}
+
+	require.Eventually(t, func() bool {
+		stats := srv.Stats()
+		return stats.Received == 4+2*12 &&
+			stats.Malformed+stats.Unknown+stats.Late+stats.Duplicate+stats.Matched+stats.Dropped == stats.Received
+	}, time.Second, 10*time.Millisecond, "%+v", srv.Stats())
+	stats := srv.Stats()
+	require.Equal(t, uint64(12), stats.Matched)
+	require.Equal(t, uint64(1), stats.Malformed)
+	require.GreaterOrEqual(t, stats.Unknown, uint64(3))
+	require.Greater(t, stats.Duplicate, uint64(0))
+}
+
+// chanTransport records the probes sent, and receives the replies sent to
+// its channel only.
+type chanTransport struct {
+	probes  chan traceroute.Probe
+	replies chan noisyPacket
+	close   chan struct{}
+	once    sync.Once
+}
+
+func newChanTransport() *chanTransport {
+	return &chanTransport{
+		probes:  make(chan traceroute.Probe, 16),
+		replies: make(chan noisyPacket),
+		close:   make(chan struct{}),
+	}
+}
+
+func (t *chanTransport) Send(probe traceroute.Probe) error {
+	t.probes <- probe
+	return nil
+}
+
+func (t *chanTransport) Recv(b []byte) (traceroute.Reply, error) {
+	select {
+	case <-t.close:
+		return traceroute.Reply{}, errors.New("transport closed")
+	case pkt := <-t.replies:
+		pkt.reply.N = copy(b, pkt.bytes)
+		return pkt.reply, nil
+	}
+}
+
+func (t *chanTransport) Close() error {
+	t.once.Do(func() { close(t.close) })
+	return nil
+}
+
+func (t *chanTransport) segment(tb testing.TB, from string, tcp netpacket.TCPv4) {
+	header := ipv4.Header{Protocol: 6, Src: net.ParseIP(from), Dst: net.ParseIP(simSrc)}
+	b, err := tcp.Marshal(header, nil)
+	require.NoError(tb, err)
+	t.replies <- noisyPacket{
+		reply: traceroute.Reply{Protocol: 6, From: header.Src, RecvTime: time.Now()},
+		bytes: b,
+	}
+}
+
+func TestServer_TCPNoise(t *testing.T) {
+	transport := newChanTransport()
+	srv, err := traceroute.NewServer(traceroute.Config{LocalSrcIP: net.ParseIP(simSrc), Transport: transport})
+	require.NoError(t, err)
+	defer srv.Shutdown()
+	opts := traceroute.Options{Protocol: traceroute.ProtocolTCP, Port: 443, MaxHop: 1, Attempts: 1, Timeout: 10 * time.Second}
+	future, err := srv.Traceroute(context.Background(), simDst, opts)
+	require.NoError(t, err)
+
+	probe := <-transport.probes
+	var syn netpacket.TCPv4
+	require.NoError(t, syn.Unmarshal(probe.Payload))
+	// raw TCP socket sees all TCP traffic on host, none of which is counted:
+	// segments of other connections, SYN-ACK to other ports, segments other
+	// than SYN-ACK or RST, and RST from other hosts
+	transport.segment(t, "8.8.8.8", netpacket.TCPv4{SrcPort: 22, DstPort: 50000, Flags: netpacket.TCPFlagACK})
+	transport.segment(t, simDst, netpacket.TCPv4{SrcPort: syn.DstPort, DstPort: syn.SrcPort + 1, Ack: syn.Seq + 1,
+		Flags: netpacket.TCPFlagSYN | netpacket.TCPFlagACK})
+	transport.segment(t, simDst, netpacket.TCPv4{SrcPort: syn.DstPort, DstPort: syn.SrcPort, Ack: syn.Seq + 1,
+		Flags: netpacket.TCPFlagACK})
+	transport.segment(t, "8.8.8.8", netpacket.TCPv4{SrcPort: syn.DstPort, DstPort: syn.SrcPort, Ack: syn.Seq + 1,
+		Flags: netpacket.TCPFlagRST})
+	transport.replies <- noisyPacket{reply: traceroute.Reply{Protocol: 6, From: net.ParseIP(simDst)}, bytes: []byte{1, 2, 3}}
+
+	transport.segment(t, simDst, netpacket.TCPv4{SrcPort: syn.DstPort, DstPort: syn.SrcPort, Ack: syn.Seq + 1,
+		Flags: netpacket.TCPFlagSYN | netpacket.TCPFlagACK})
+	require.NoError(t, future.Error())
+	require.True(t, future.Result().Reach)
+	require.Equal(t, traceroute.Stats{Received: 1, Matched: 1}, srv.Stats())
+}
+
+func TestServer_Coalesce(t *testing.T) {
+	transport := newChanTransport()
+	srv, err := traceroute.NewServer(traceroute.Config{LocalSrcIP: net.ParseIP(simSrc), Transport: transport})
+	require.NoError(t, err)
+	defer srv.Shutdown()
+
+	// probes are never replied, so the session runs until it's cancelled
+	opts := traceroute.Options{MaxHop: 1, Attempts: 1, Timeout: 10 * time.Second, Coalesce: true}
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	defer cancel1()
+	first, err := srv.Traceroute(ctx1, simDst, opts)
+	require.NoError(t, err)
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	defer cancel2()
+	second, err := srv.Traceroute(ctx2, simDst, opts)
+	require.NoError(t, err)
+	require.Same(t, first, second)
+	errc := make(chan error, 1)
+	go func() { errc <- first.Error() }()
+
+	// session keeps running for the other caller after the one starting it
+	// cancels
+	cancel1()
+	select {
+	case err := <-errc:
+		t.Fatalf("session finished after first caller cancels: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// and is cancelled once the last caller cancels, which isn't shared
+	// with new callers any more
+	cancel2()
+	select {
+	case err := <-errc:
+		require.ErrorIs(t, err, context.Canceled)
+	case <-time.After(time.Second):
+		t.Fatal("session isn't cancelled after all callers cancel")
+	}
+	ctx3, cancel3 := context.WithCancel(context.Background())
+	defer cancel3()
+	third, err := srv.Traceroute(ctx3, simDst, opts)
+	require.NoError(t, err)
+	require.NotSame(t, first, third)
+}
+
+// fakeResolver names routers by their address, and fails destination lookups.
+type fakeResolver struct {
+	mu             sync.Mutex
+	lookups        int
+	concurrent     int
+	maxConcurrency int
+}
+
+func (r *fakeResolver) LookupAddr(_ context.Context, addr string) ([]string, error) {
+	r.mu.Lock()
+	r.lookups++
+	r.concurrent++
+	if r.concurrent > r.maxConcurrency {
+		r.maxConcurrency = r.concurrent
+	}
+	r.mu.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+	r.mu.Lock()
+	r.concurrent--
+	r.mu.Unlock()
+	if !strings.HasPrefix(addr, "10.") {
+		return nil, errors.New("no such host")
+	}
+	return []string{"r-" + strings.ReplaceAll(addr, ".", "-") + ".example."}, nil
+}
+
+func testSimulatorNames(t *testing.T) {
+	resolver := &fakeResolver{}
+	srv, err := traceroute.NewServer(traceroute.Config{
+		LocalSrcIP:           net.ParseIP(simSrc),
+		Transport:            newSimulator(),
+		Resolver:             resolver,
+		MaxConcurrentLookups: 2,
+	})
+	require.NoError(t, err)
+	defer srv.Shutdown()
+
+	opts := traceroute.Options{Timeout: 100 * time.Millisecond, LookupNames: true, Attempts: 16}
+	for i := 0; i < 2; i++ {
+		future, err := srv.Traceroute(context.Background(), simDst, opts)
+		require.NoError(t, err)
+		require.NoError(t, future.Error())
+		for _, hop := range future.Result().Hops {
+			for _, node := range hop.Nodes {
+				if node.IP.String() == simDst {
+					require.Empty(t, node.Hostname)
+				} else {
+					require.Equal(t, "r-"+strings.ReplaceAll(node.IP.String(), ".", "-")+".example", node.Hostname)
+				}
+			}
+		}
+	}
+	// 5 distinct addresses are looked up once, then cached for next session
+	require.Equal(t, 5, resolver.lookups)
+	require.Equal(t, 2, resolver.maxConcurrency)
+
+	future, err := srv.Traceroute(context.Background(), simDst, traceroute.Options{Timeout: 100 * time.Millisecond})
+	require.NoError(t, err)
+	require.Empty(t, future.Result().Hops[0].Nodes[0].Hostname)
+}
+
+func testSimulatorNamesDedup(t *testing.T) {
+	resolver := &fakeResolver{}
+	srv, err := traceroute.NewServer(traceroute.Config{
+		LocalSrcIP:           net.ParseIP(simSrc),
+		Transport:            newSimulator(),
+		Resolver:             resolver,
+		MaxConcurrentLookups: 2,
+	})
+	require.NoError(t, err)
+	defer srv.Shutdown()
+
+	// sessions finish together, and look up the same addresses concurrently
+	opts := traceroute.Options{Timeout: 100 * time.Millisecond, LookupNames: true}
+	var futures []*traceroute.Future
+	for i := 0; i < 4; i++ {
+		future, err := srv.Traceroute(context.Background(), simDst, opts)
+		require.NoError(t, err)
+		futures = append(futures, future)
+	}
+	for _, future := range futures {
+		require.NoError(t, future.Error())
+		require.Equal(t, "r-10-0-0-1.example", future.Result().Hops[0].Nodes[0].Hostname)
+	}
+	resolver.mu.Lock()
+	defer resolver.mu.Unlock()
+	require.Equal(t, 5, resolver.lookups)
+}
+
+func testSimulatorExtensions(t *testing.T) {
+	network := newSimulator()
+	network.AddRouter("10.0.2.1").Extensions = []icmp.Extension{
+		&icmp.MPLSLabelStack{Class: 1, Type: 1, Labels: []icmp.MPLSLabel{
+			{Label: 16005, TC: 0, S: false, TTL: 1},
+			{Label: 24001, TC: 5, S: true, TTL: 1},
+		}},
+		&icmp.InterfaceInfo{Class: 2, Type: 0x0f, // incoming interface with all attributes
+			Interface: &net.Interface{Index: 7, Name: "ge-0/0/1", MTU: 1500},
+			Addr:      &net.IPAddr{IP: net.ParseIP("10.0.2.1").To4()},
+		},
+	}
+
+	result := simulate(t, network, traceroute.Options{MaxHop: 4, Timeout: 100 * time.Millisecond})
+	require.Len(t, result.Hops, 4)
+	for _, attempt := range result.Hops[1].Attempts {
+		require.Empty(t, attempt.MPLSLabels)
+		require.Empty(t, attempt.Interfaces)
+	}
+	for _, attempt := range result.Hops[2].Attempts {
+		require.Equal(t, traceroute.OutcomeReply, attempt.Outcome)
+		require.Equal(t, []traceroute.MPLSLabel{
+			{Label: 16005, TC: 0, S: false, TTL: 1},
+			{Label: 24001, TC: 5, S: true, TTL: 1},
+		}, attempt.MPLSLabels)
+		require.Len(t, attempt.Interfaces, 1)
+		iface := attempt.Interfaces[0]
+		require.Equal(t, traceroute.InterfaceRoleIncoming, iface.Role)
+		require.Equal(t, 7, iface.IfIndex)
+		require.Equal(t, "ge-0/0/1", iface.Name)
+		require.Equal(t, 1500, iface.MTU)
+		require.Equal(t, "10.0.2.1", iface.IP.String())
+	}
+}
+
+func testSimulatorProhibited(t *testing.T) {
+	network := newSimulator()
+	network.AddRouter("10.0.2.1").Unreachable = 13 // communication administratively prohibited
+
+	result := simulate(t, network, traceroute.Options{MaxHop: 4, Timeout: 100 * time.Millisecond})
+	require.False(t, result.Reach)
+	require.Len(t, result.Hops, 4)
+	for _, hop := range result.Hops[2:] {
+		require.Equal(t, []string{"10.0.2.1"}, hopIPs(hop))
+		for _, attempt := range hop.Attempts {
+			require.Equal(t, 3, attempt.ICMPType)
+			require.Equal(t, 13, attempt.ICMPCode)
+			require.Equal(t, "!X", attempt.Annotation())
+		}
+	}
+	require.Equal(t, 2, result.Hops[3].Attempts[0].QuotedTTL)
+}
+
+func testSimulatorMonitor(t *testing.T) {
+	srv, err := traceroute.NewServer(traceroute.Config{LocalSrcIP: net.ParseIP(simSrc), Transport: newSimulator()})
+	require.NoError(t, err)
+	defer srv.Shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opts := traceroute.Options{MaxHop: 8, Attempts: 2, Timeout: 100 * time.Millisecond}
+	snapshots, err := srv.Monitor(ctx, simDst, opts, 10*time.Millisecond)
+	require.NoError(t, err)
+
+	var last traceroute.Snapshot
+	for snapshot := range snapshots {
+		require.NoError(t, snapshot.Err)
+		require.Equal(t, last.Round+1, snapshot.Round)
+		last = snapshot
+		if snapshot.Round == 3 {
+			cancel()
+		}
+	}
+	require.Equal(t, 3, last.Round)
+	require.True(t, last.Reach)
+	require.Len(t, last.Hops, 4)
+	for i, hop := range last.Hops {
+		require.Equal(t, i+1, hop.TTL)
+		require.Equal(t, 6, hop.Sent)
+		require.Equal(t, 6, hop.Received)
+		require.Zero(t, hop.Loss)
+		require.GreaterOrEqual(t, hop.Best, time.Duration(2*(i+1))*time.Millisecond)
+		require.LessOrEqual(t, hop.Best, hop.Avg)
+		require.LessOrEqual(t, hop.Avg, hop.Worst)
+		require.NotZero(t, hop.Last)
+	}
+	for _, ip := range last.Hops[1].IPs { // load balanced hop
+		require.Contains(t, []string{"10.0.1.1", "10.0.1.2"}, ip.String())
+	}
+	require.Equal(t, simDst, last.Hops[3].IPs[0].String())
+}
+
+func testSimulatorPMTU(t *testing.T) {
+	newNetwork := func() *traceroutetest.Network {
+		network := traceroutetest.NewNetwork(simSrc, 1)
+		for _, ip := range []string{"10.0.0.1", "10.0.1.1", "10.0.2.1"} {
+			network.AddRouter(ip)
+		}
+		network.AddHost(simDst)
+		network.Chain(time.Millisecond, simSrc, "10.0.0.1")
+		network.Connect("10.0.0.1", "10.0.1.1", time.Millisecond).MTU = 1400
+		network.Connect("10.0.1.1", "10.0.2.1", time.Millisecond).MTU = 1300
+		network.Chain(time.Millisecond, "10.0.2.1", simDst)
+		return network
+	}
+
+	for _, opts := range []traceroute.Options{
+		{Protocol: traceroute.ProtocolUDP},
+		{Protocol: traceroute.ProtocolICMP},
+		{Protocol: traceroute.ProtocolUDP, Paris: true},
+	} {
+		opts.MaxHop, opts.Timeout, opts.PMTU = 8, 100*time.Millisecond, true
+		result := simulate(t, newNetwork(), opts)
+		require.True(t, result.Reach, "%+v", opts)
+		require.Equal(t, 1300, result.PathMTU)
+		require.Equal(t, []traceroute.MTUChange{
+			{TTL: 2, From: net.ParseIP("10.0.0.1"), MTU: 1400},
+			{TTL: 3, From: net.ParseIP("10.0.1.1"), MTU: 1300},
+		}, result.MTUChanges)
+		require.Len(t, result.Hops, 4)
+		for i, ip := range []string{"10.0.0.1", "10.0.1.1", "10.0.2.1", simDst} {
+			hop := result.Hops[i]
+			require.Equal(t, []string{ip}, hopIPs(hop), "%+v", opts)
+			require.Equal(t, 3, hop.Sent)
+			require.Equal(t, 3, hop.Received)
+		}
+		for _, attempt := range result.Hops[1].Attempts {
+			if attempt.Outcome == traceroute.OutcomeTooBig {
+				require.Equal(t, "!F-1400", attempt.Annotation())
+			}
+		}
+	}
+
+	srv, err := traceroute.NewServer(traceroute.Config{LocalSrcIP: net.ParseIP(simSrc), Transport: newNetwork()})
+	require.NoError(t, err)
+	defer srv.Shutdown()
+	_, err = srv.Traceroute(context.Background(), simDst, traceroute.Options{Protocol: traceroute.ProtocolTCP, PMTU: true})
+	require.Error(t, err)
 }
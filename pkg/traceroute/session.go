@@ -2,31 +2,45 @@ package traceroute
 
 import (
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
 	"time"
 
 	netpacket "github.com/visonhuo/mykit/internal/net/packet"
+	"golang.org/x/net/icmp"
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
-type probePacket struct {
-	identify int
+type probeRecord struct {
+	ttl      int
+	attempt  int // index of attempt in hop
 	sendTime time.Time
+	mtu      int // IP packet length of probe in PMTU mode
 }
 
 type session struct {
 	ctx     context.Context
 	server  *Server
 	dstIP   net.IP
+	srcPort int
+	echoID  int
 	packetQ chan packet
 	future  *Future
+	// Coalesced session runs on a detached context, which is cancelled by
+	// cancel once all of its callers cancel. callers is guarded by
+	// Server.coalesceMu.
+	cancel  context.CancelFunc
+	callers int
 }
 
 func (s *session) init() error {
+	s.srcPort = randomPort()
+	s.echoID = s.srcPort & 0xffff
 	s.packetQ = make(chan packet, 16)
-	s.future = &Future{finish: make(chan struct{})}
+	s.future = newFuture()
 	return nil
 }
 
@@ -35,6 +49,8 @@ func (s *session) run(opts Options) {
 	var result = Result{DstIP: s.dstIP, Opts: opts}
 	var err error
 	defer func() {
+		s.server.unregister(s, opts)
+		s.drain()
 		if e := recover(); e != nil {
 			s.future.done(result, fmt.Errorf("panic: %v", e))
 		} else {
@@ -42,82 +58,301 @@ func (s *session) run(opts Options) {
 		}
 	}()
 
-	pc := make(chan probePacket, 16)
-	go s.sendProbePackets(pc, opts)
+	if opts.Multipath {
+		err = s.runMDA(&result)
+	} else {
+		err = s.runWindow(&result)
+	}
+	if err == nil && opts.LookupNames {
+		s.server.lookupNames(s.ctx, &result)
+	}
+}
+
+// runWindow sends probes TTL by TTL, keeping at most Options.Window TTLs in
+// flight ahead of the lowest TTL still waiting for replies. It stops sending
+// as soon as the destination replies, and drops the hops beyond it, which are
+// never published to subscribers either.
+//
+// In PMTU mode, probes are sized to the MTU of path discovered so far. The
+// probe too big to be forwarded is resent in the smaller MTU reported by the
+// router before the link of that MTU.
+func (s *session) runWindow(result *Result) error {
+	opts := result.Opts
+	w := probeWindow{
+		nextTTL:  opts.FirstHop,
+		dstTTL:   opts.MaxHop,
+		inflight: make(map[uint16]probeRecord, opts.Window*opts.Attempts),
+		finished: make(map[uint16]bool),
+	}
+	payload := make([]byte, opts.PacketSize)
+	mtu := opts.MTU
+	if opts.PMTU {
+		payload = make([]byte, mtuPayloadSize(mtu, s.server.isIPv6()))
+		defer func() { result.PathMTU = mtu }()
+	}
+	send := func(ttl int) {
+		w.identify = nextIdentify(w.identify)
+		sendTime, err := s.sendProbe(opts, w.identify, ttl, 0, payload)
+		attempt := result.attempt(ttl, err)
+		if err != nil {
+			s.logf("Write %v packet failed (%v):%v", opts.Protocol, s.dstIP, err)
+			return
+		}
+		w.inflight[uint16(w.identify)] = probeRecord{ttl: ttl, attempt: attempt, sendTime: sendTime, mtu: mtu}
+	}
+	timer := time.NewTimer(opts.Timeout)
+	defer timer.Stop()
+	for {
+		w.expire(time.Now(), opts.Timeout)
+		for w.nextTTL <= w.dstTTL && w.nextTTL < w.lowestTTL()+opts.Window {
+			for i := 0; i < opts.Attempts; i++ {
+				send(w.nextTTL)
+			}
+			w.nextTTL++
+		}
+		w.release(s.future)
+		if len(w.inflight) == 0 && w.nextTTL > w.dstTTL {
+			result.truncate(w.dstTTL)
+			return nil
+		}
+		resetTimer(timer, time.Until(w.deadline(opts.Timeout)))
 
-	id2SendTime := make(map[int]time.Time, (opts.MaxHop-opts.FirstHop)*opts.Attempts)
-	var timeC <-chan time.Time
-	timeout := false
-	for !timeout {
 		select {
 		case <-s.ctx.Done():
-			err = s.ctx.Err()
-			return
+			return s.ctx.Err()
 
 		case <-s.server.close:
-			err = errors.New("server closed")
-			return
-
-		case <-timeC:
-			timeout = true
-			break
+			return errors.New("server closed")
 
-		case probe, ok := <-pc:
-			if !ok { // finish sending
-				timeC = time.NewTimer(opts.Timeout).C
-				pc = nil
-				break
-			}
-			id2SendTime[probe.identify] = probe.sendTime
+		case <-timer.C:
 
 		case pkt := <-s.packetQ:
-			sendTime, ok := id2SendTime[pkt.identify]
+			identify, ok := s.probeIdentify(pkt, opts)
 			if !ok {
+				s.count(&s.server.stats.unknown)
 				continue
 			}
-			rtt := pkt.recvTime.Sub(sendTime)
+			probe, ok := w.inflight[identify]
+			if !ok {
+				if replied, ok := w.finished[identify]; !ok {
+					s.count(&s.server.stats.unknown)
+				} else if replied {
+					s.count(&s.server.stats.duplicate)
+				} else {
+					s.count(&s.server.stats.late)
+				}
+				continue
+			}
+			rtt := pkt.recvTime.Sub(probe.sendTime)
 			if rtt > opts.Timeout {
+				w.finish(identify, false)
+				s.count(&s.server.stats.late)
 				continue
 			}
+			w.finish(identify, true)
 
-			ttl := ((pkt.identify - 1) / opts.Attempts) + opts.FirstHop
-			result.aggregate(ttl, pkt.addr.IP, rtt)
+			if opts.PMTU && pkt.isTooBig() {
+				result.tooBig(probe.ttl, probe.attempt, newReply(pkt, rtt))
+				s.count(&s.server.stats.matched)
+				next := nextMTU(pkt.mtu, probe.mtu, s.server.isIPv6())
+				result.dropMTU(probe.ttl, pkt.addr.IP, next)
+				if next < mtu {
+					mtu = next
+					payload = make([]byte, mtuPayloadSize(mtu, s.server.isIPv6()))
+				}
+				if mtu < probe.mtu && probe.ttl <= w.dstTTL {
+					send(probe.ttl)
+				}
+				continue
+			}
+			if !pkt.addr.IP.Equal(s.dstIP) && !pkt.isPortUnreachable() {
+				s.aggregate(result, probe.ttl, probe.attempt, newReply(pkt, rtt))
+				continue
+			}
+			// destination replies to every probe beyond it as well, which
+			// are held until the lower TTLs are finished, since the hops
+			// beyond destination are dropped from result.
+			reply := newReply(pkt, rtt)
+			result.aggregate(probe.ttl, probe.attempt, reply)
+			s.count(&s.server.stats.matched)
+			w.held = append(w.held, Event{TTL: probe.ttl, IP: reply.From, RTT: reply.RTT})
+			if probe.ttl < w.dstTTL {
+				w.reach(probe.ttl)
+			}
 		}
 	}
 }
 
-func (s *session) sendProbePackets(pc chan<- probePacket, opts Options) {
-	defer close(pc)
+type probeWindow struct {
+	identify int
+	nextTTL  int // next TTL to probe
+	dstTTL   int // TTL of destination, or MaxHop if not reached yet
+	// inflight is keyed by the identify carried in 16-bit header fields, so
+	// that replies still match after identify wraps around.
+	inflight map[uint16]probeRecord
+	// finished records whether the probe no longer inflight was replied,
+	// to tell duplicate replies from late ones.
+	finished map[uint16]bool
+	// held is the replies of destination not published yet.
+	held []Event
+}
 
-	var identify int
-	srcPort := randomPort()
-	payload := make([]byte, opts.PacketSize)
-	for ttl := opts.FirstHop; ttl <= opts.MaxHop; ttl++ {
-		for i := 0; i < opts.Attempts; i++ {
-			if s.future.isDone() {
-				return
-			}
+func (w *probeWindow) finish(identify uint16, replied bool) {
+	delete(w.inflight, identify)
+	w.finished[identify] = replied
+}
 
-			identify += 1
-			dstPort := identify + opts.Port
-			header, udpPktBytes, err := s.generalUDPPacket(srcPort, dstPort, identify, ttl, payload)
-			if err != nil {
-				s.logf("General UDP packet failed (%v):%v", s.dstIP, err)
-				continue
-			}
+// expire forgets the probes which are unanswered after timeout.
+func (w *probeWindow) expire(now time.Time, timeout time.Duration) {
+	for identify, probe := range w.inflight {
+		if !now.Before(probe.sendTime.Add(timeout)) {
+			w.finish(identify, false)
+		}
+	}
+}
 
-			sendTime := time.Now()
-			err = s.server.write(header, udpPktBytes)
-			if err != nil {
-				s.logf("Write UDP packet failed (%v):%v", s.dstIP, err)
-				continue
-			}
-			pc <- probePacket{
-				identify: identify,
-				sendTime: sendTime,
-			}
+// lowestTTL returns the lowest TTL still waiting for replies.
+func (w *probeWindow) lowestTTL() int {
+	lowest := w.nextTTL
+	for _, probe := range w.inflight {
+		if probe.ttl < lowest {
+			lowest = probe.ttl
+		}
+	}
+	return lowest
+}
+
+// deadline returns the time when the earliest inflight probe expires.
+func (w *probeWindow) deadline(timeout time.Duration) time.Time {
+	var deadline time.Time
+	for _, probe := range w.inflight {
+		if expire := probe.sendTime.Add(timeout); deadline.IsZero() || expire.Before(deadline) {
+			deadline = expire
+		}
+	}
+	return deadline
+}
+
+// reach records the destination replied to probe of ttl, the probes beyond
+// it are needless anymore.
+func (w *probeWindow) reach(ttl int) {
+	w.dstTTL = ttl
+	for identify, probe := range w.inflight {
+		if probe.ttl > ttl {
+			w.finish(identify, false)
+		}
+	}
+}
+
+// release publishes the replies held to f, once no probe of lower TTL is
+// waiting for replies, so that the destination TTL is settled. Replies beyond
+// destination TTL are dropped.
+func (w *probeWindow) release(f *Future) {
+	lowest := w.lowestTTL()
+	held := w.held[:0]
+	for _, event := range w.held {
+		switch {
+		case event.TTL > w.dstTTL:
+		case event.TTL <= lowest:
+			f.publish(event.TTL, event.IP, event.RTT)
+		default:
+			held = append(held, event)
+		}
+	}
+	w.held = held
+}
+
+// drain discards the replies left in queue after session finished, which are
+// counted as late replies.
+func (s *session) drain() {
+	for {
+		select {
+		case <-s.packetQ:
+			s.count(&s.server.stats.late)
+		default:
+			return
+		}
+	}
+}
+
+// count increases the packet counter of server.
+func (s *session) count(counter *uint64) {
+	s.server.stats.inc(counter)
+}
+
+func resetTimer(timer *time.Timer, d time.Duration) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(d)
+}
+
+// aggregate records the reply into result, and publishes it to subscribers.
+func (s *session) aggregate(result *Result, ttl, attempt int, reply Attempt) {
+	result.aggregate(ttl, attempt, reply)
+	s.count(&s.server.stats.matched)
+	s.future.publish(ttl, reply.From, reply.RTT)
+}
+
+// newReply returns the attempt record of reply pkt.
+func newReply(pkt packet, rtt time.Duration) Attempt {
+	return Attempt{
+		Outcome:    OutcomeReply,
+		From:       pkt.addr.IP,
+		RTT:        rtt,
+		ICMPType:   pkt.icmpType,
+		ICMPCode:   pkt.icmpCode,
+		ReplyTTL:   pkt.ttl,
+		QuotedTTL:  pkt.quotedTTL,
+		MTU:        pkt.mtu,
+		MPLSLabels: pkt.mpls,
+		Interfaces: pkt.interfaces,
+	}
+}
+
+// sendProbe sends the probe packet of identify to ttl. In Paris mode, flow
+// selects the flow identifier of probe, which keeps constant for a given flow.
+func (s *session) sendProbe(opts Options, identify, ttl, flow int, payload []byte) (time.Time, error) {
+	switch opts.Protocol {
+	case ProtocolICMP: // constant checksum in Paris mode, identify by sequence only
+		return s.sendICMPPacket(identify, ttl, payload, opts.Paris, uint16(s.srcPort^flow))
+	case ProtocolTCP: // 5-tuple of TCP probe is always constant
+		return s.sendTCPPacket(opts.Port, identify, ttl)
+	default:
+		dstPort := identify + opts.Port
+		if opts.Paris { // constant destination port, identify by checksum
+			dstPort = opts.Port + flow
+		}
+		return s.sendUDPPacket(s.srcPort, dstPort, identify, ttl, payload, opts.Paris, uint16(identify))
+	}
+}
+
+// probeIdentify returns the identify of probe which pkt replies to, it returns
+// false if pkt doesn't belong to this session. Identify is truncated to the 16
+// bits carried by probe.
+func (s *session) probeIdentify(pkt packet, opts Options) (uint16, bool) {
+	// replies without quoted transport header carry no session identity, they
+	// are matched by IP ID only.
+	if pkt.sessionID() != 0 {
+		if opts.Protocol == ProtocolICMP && pkt.echoID != s.echoID {
+			return 0, false
+		}
+		if opts.Protocol != ProtocolICMP && pkt.srcPort != s.srcPort {
+			return 0, false
+		}
+	}
+	identify := pkt.identify
+	if opts.Protocol == ProtocolUDP && pkt.quoted {
+		if opts.Paris {
+			identify = pkt.checksum
+		} else {
+			identify = pkt.dstPort - opts.Port
 		}
 	}
+	return uint16(identify), true
 }
 
 func (s *session) acceptPacket(pkt packet) {
@@ -129,10 +364,80 @@ func (s *session) acceptPacket(pkt packet) {
 	select {
 	case s.packetQ <- pkt:
 	case <-timer.C:
+		s.count(&s.server.stats.dropped)
 		s.logf("Handle packet timeout: %v", pkt)
 	}
 }
 
+// sendUDPPacket sends an UDP probe, the checksum of probe is set to csum by
+// tweaking the payload if patch is true.
+func (s *session) sendUDPPacket(srcPort, dstPort, identify, ttl int, payload []byte, patch bool, csum uint16) (time.Time, error) {
+	if s.server.isIPv6() {
+		header, udpPktBytes, err := s.generalUDPv6Packet(srcPort, dstPort, ttl, payload)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if patch {
+			if err := patchChecksum(udpPktBytes, udpChecksumOffset, udpHeaderLen, csum); err != nil {
+				return time.Time{}, err
+			}
+		}
+		sendTime := time.Now()
+		return sendTime, s.server.write6(header, udpPktBytes)
+	}
+
+	header, udpPktBytes, err := s.generalUDPPacket(srcPort, dstPort, identify, ttl, payload)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if patch {
+		if err := patchChecksum(udpPktBytes, udpChecksumOffset, udpHeaderLen, csum); err != nil {
+			return time.Time{}, err
+		}
+	}
+	sendTime := time.Now()
+	return sendTime, s.server.write(header, udpPktBytes)
+}
+
+// sendICMPPacket sends an ICMP echo probe, the checksum of probe is set to csum
+// by tweaking the payload if patch is true.
+func (s *session) sendICMPPacket(identify, ttl int, payload []byte, patch bool, csum uint16) (time.Time, error) {
+	if s.server.isIPv6() {
+		header, icmpPktBytes, err := s.generalICMPv6Packet(identify, ttl, payload)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if patch {
+			if err := patchChecksum(icmpPktBytes, icmpChecksumOffset, icmpEchoHeaderLen, csum); err != nil {
+				return time.Time{}, err
+			}
+		}
+		sendTime := time.Now()
+		return sendTime, s.server.write6(header, icmpPktBytes)
+	}
+
+	header, icmpPktBytes, err := s.generalICMPPacket(identify, ttl, payload)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if patch {
+		if err := patchChecksum(icmpPktBytes, icmpChecksumOffset, icmpEchoHeaderLen, csum); err != nil {
+			return time.Time{}, err
+		}
+	}
+	sendTime := time.Now()
+	return sendTime, s.server.write(header, icmpPktBytes)
+}
+
+func (s *session) sendTCPPacket(dstPort, identify, ttl int) (time.Time, error) {
+	header, tcpPktBytes, err := s.generalTCPPacket(dstPort, identify, ttl)
+	if err != nil {
+		return time.Time{}, err
+	}
+	sendTime := time.Now()
+	return sendTime, s.server.write(header, tcpPktBytes)
+}
+
 func (s *session) generalUDPPacket(srcPort, dstPort, identify, ttl int, payload []byte) (ipv4.Header, []byte, error) {
 	ipHeader := ipv4.Header{
 		Version:  ipv4.Version,
@@ -156,6 +461,122 @@ func (s *session) generalUDPPacket(srcPort, dstPort, identify, ttl int, payload
 	return ipHeader, udpBytes, nil
 }
 
+func (s *session) generalUDPv6Packet(srcPort, dstPort, ttl int, payload []byte) (ipv6.Header, []byte, error) {
+	ipHeader := ipv6.Header{
+		Version:    ipv6.Version,
+		NextHeader: protocolUDP,
+		HopLimit:   ttl,
+		Src:        s.server.config.LocalSrcIP,
+		Dst:        s.dstIP,
+	}
+	udp := netpacket.UDPv6{
+		SrcPort: uint16(srcPort),
+		DstPort: uint16(dstPort),
+	}
+	udpBytes, err := udp.Marshal(ipHeader, payload)
+	if err != nil {
+		return ipHeader, nil, err
+	}
+	ipHeader.PayloadLen = len(udpBytes)
+	return ipHeader, udpBytes, nil
+}
+
+// generalTCPPacket builds a TCP SYN probe, the identify is carried by sequence
+// number, so that it can be recovered from the acknowledge number of reply.
+func (s *session) generalTCPPacket(dstPort, identify, ttl int) (ipv4.Header, []byte, error) {
+	ipHeader := ipv4.Header{
+		Version:  ipv4.Version,
+		Len:      ipv4.HeaderLen,
+		ID:       identify,
+		Flags:    ipv4.DontFragment,
+		TTL:      ttl,
+		Protocol: protocolTCP,
+		Src:      s.server.config.LocalSrcIP,
+		Dst:      s.dstIP,
+	}
+	tcp := netpacket.TCPv4{
+		SrcPort: uint16(s.srcPort),
+		DstPort: uint16(dstPort),
+		Seq:     uint32(identify),
+		Flags:   netpacket.TCPFlagSYN,
+		Options: []netpacket.TCPOption{netpacket.MSSOption(defaultTCPMSS)},
+	}
+	tcpBytes, err := tcp.Marshal(ipHeader, nil)
+	if err != nil {
+		return ipHeader, nil, err
+	}
+	ipHeader.TotalLen = ipv4.HeaderLen + len(tcpBytes)
+	return ipHeader, tcpBytes, nil
+}
+
+func (s *session) generalICMPPacket(identify, ttl int, payload []byte) (ipv4.Header, []byte, error) {
+	ipHeader := ipv4.Header{
+		Version:  ipv4.Version,
+		Len:      ipv4.HeaderLen,
+		ID:       identify,
+		Flags:    ipv4.DontFragment,
+		TTL:      ttl,
+		Protocol: protocolICMPv4,
+		Src:      s.server.config.LocalSrcIP,
+		Dst:      s.dstIP,
+	}
+	msg := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: s.echoID, Seq: identify, Data: payload},
+	}
+	icmpBytes, err := msg.Marshal(nil)
+	if err != nil {
+		return ipHeader, nil, err
+	}
+	ipHeader.TotalLen = ipv4.HeaderLen + len(icmpBytes)
+	return ipHeader, icmpBytes, nil
+}
+
+func (s *session) generalICMPv6Packet(identify, ttl int, payload []byte) (ipv6.Header, []byte, error) {
+	ipHeader := ipv6.Header{
+		Version:    ipv6.Version,
+		NextHeader: protocolICMPv6,
+		HopLimit:   ttl,
+		Src:        s.server.config.LocalSrcIP,
+		Dst:        s.dstIP,
+	}
+	msg := icmp.Message{
+		Type: ipv6.ICMPTypeEchoRequest,
+		Body: &icmp.Echo{ID: s.echoID, Seq: identify, Data: payload},
+	}
+	icmpBytes, err := msg.Marshal(icmp.IPv6PseudoHeader(ipHeader.Src, ipHeader.Dst))
+	if err != nil {
+		return ipHeader, nil, err
+	}
+	ipHeader.PayloadLen = len(icmpBytes)
+	return ipHeader, icmpBytes, nil
+}
+
 func (s *session) logf(format string, args ...interface{}) {
 	s.server.logf(format, args...)
 }
+
+// patchChecksum sets checksum of marshalled transport packet b to want, by
+// rewriting the first (zero) word of payload at payloadOffset. Header fields,
+// thus the flow identifier seen by ECMP routers, keep unchanged. Zero is a
+// valid checksum to pin as well.
+func patchChecksum(b []byte, csumOffset, payloadOffset int, want uint16) error {
+	if len(b) < payloadOffset+2 {
+		return errors.New("payload is too short to patch checksum")
+	}
+	patch := netpacket.ChecksumPatch(binary.BigEndian.Uint16(b[csumOffset:]), want)
+	binary.BigEndian.PutUint16(b[payloadOffset:], patch)
+	binary.BigEndian.PutUint16(b[csumOffset:], want)
+	return nil
+}
+
+// nextIdentify returns the identify of next probe. Identify is carried by
+// 16-bit header fields, and the ones of which low 16 bits are zero are
+// skipped, since zero UDP checksum of Paris probe means no checksum at all.
+func nextIdentify(identify int) int {
+	identify++
+	if uint16(identify) == 0 {
+		identify++
+	}
+	return identify
+}
@@ -0,0 +1,242 @@
+package traceroute
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+var (
+	testSrc    = net.ParseIP("192.0.2.1").To4()
+	testRouter = net.ParseIP("10.0.0.1").To4()
+	testDst    = net.ParseIP("198.51.100.1").To4()
+)
+
+// loopTransport captures the probes sent, and receives the replies injected
+// by test.
+type loopTransport struct {
+	probes  chan Probe
+	replies chan Reply
+	bytes   chan []byte
+	close   chan struct{}
+	once    sync.Once
+}
+
+func newLoopTransport() *loopTransport {
+	return &loopTransport{
+		probes:  make(chan Probe, 16),
+		replies: make(chan Reply),
+		bytes:   make(chan []byte),
+		close:   make(chan struct{}),
+	}
+}
+
+func (t *loopTransport) Send(probe Probe) error {
+	t.probes <- probe
+	return nil
+}
+
+func (t *loopTransport) Recv(b []byte) (Reply, error) {
+	select {
+	case <-t.close:
+		return Reply{}, errors.New("transport closed")
+	case reply := <-t.replies:
+		reply.N = copy(b, <-t.bytes)
+		return reply, nil
+	}
+}
+
+func (t *loopTransport) Close() error {
+	t.once.Do(func() { close(t.close) })
+	return nil
+}
+
+// reply injects ICMP message msg from ip.
+func (t *loopTransport) reply(tb testing.TB, from net.IP, msg icmp.Message) {
+	b, err := msg.Marshal(nil)
+	require.NoError(tb, err)
+	t.replies <- Reply{Protocol: protocolICMPv4, From: from, RecvTime: time.Now()}
+	t.bytes <- b
+}
+
+// timeExceeded returns the ICMP Time Exceeded message quoting probe.
+func timeExceeded(tb testing.TB, probe Probe) icmp.Message {
+	return icmp.Message{Type: ipv4.ICMPTypeTimeExceeded, Body: &icmp.TimeExceeded{Data: quote(tb, probe)}}
+}
+
+// portUnreachable returns the ICMP Port Unreachable message quoting probe.
+func portUnreachable(tb testing.TB, probe Probe) icmp.Message {
+	return icmp.Message{Type: ipv4.ICMPTypeDestinationUnreachable, Code: 3, Body: &icmp.DstUnreach{Data: quote(tb, probe)}}
+}
+
+// quote returns the IP header and leading 8 bytes of probe quoted by ICMP
+// errors.
+func quote(tb testing.TB, probe Probe) []byte {
+	header := ipv4.Header{
+		Version:  ipv4.Version,
+		Len:      ipv4.HeaderLen,
+		TotalLen: ipv4.HeaderLen + len(probe.Payload),
+		ID:       probe.ID,
+		TTL:      1,
+		Protocol: probe.Protocol,
+		Src:      probe.Src,
+		Dst:      probe.Dst,
+	}
+	b, err := header.Marshal()
+	require.NoError(tb, err)
+	return append(b, probe.Payload[:8]...)
+}
+
+// newTestSession returns a session registered to a server over loopTransport.
+func newTestSession(t *testing.T) (*session, *loopTransport) {
+	transport := newLoopTransport()
+	srv, err := NewServer(Config{LocalSrcIP: testSrc, Transport: transport})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = srv.Shutdown() })
+
+	sess := &session{ctx: context.Background(), server: srv, dstIP: testDst}
+	require.NoError(t, sess.init())
+	srv.sessions.Store(sess.srcPort, sess)
+	return sess, transport
+}
+
+// roundTrip sends the probe of identify, and returns the identify matched
+// from the Time Exceeded reply quoting it.
+func roundTrip(t *testing.T, sess *session, transport *loopTransport, opts Options, identify, flow int) (Probe, uint16) {
+	_, err := sess.sendProbe(opts, identify, 1, flow, make([]byte, 32))
+	require.NoError(t, err)
+	probe := <-transport.probes
+	transport.reply(t, testRouter, timeExceeded(t, probe))
+	pkt := <-sess.packetQ
+	matched, ok := sess.probeIdentify(pkt, opts)
+	require.True(t, ok)
+	return probe, matched
+}
+
+func TestSession_ParisChecksum(t *testing.T) {
+	t.Run("udp-wrap", func(t *testing.T) {
+		// identify wraps around after 65536 probes, and is carried by
+		// checksum, which skips zero since zero means no checksum at all.
+		sess, transport := newTestSession(t)
+		opts := Options{Protocol: ProtocolUDP, Port: 33434, Paris: true}
+		identify := 65533
+		for i := 0; i < 4; i++ {
+			identify = nextIdentify(identify)
+			require.NotZero(t, uint16(identify), identify)
+			probe, matched := roundTrip(t, sess, transport, opts, identify, 0)
+			require.Equal(t, uint16(identify), binary.BigEndian.Uint16(probe.Payload[udpChecksumOffset:]), identify)
+			require.Equal(t, uint16(identify), matched, identify)
+			require.Equal(t, uint16(opts.Port), binary.BigEndian.Uint16(probe.Payload[2:]), identify)
+		}
+	})
+
+	t.Run("icmp-zero", func(t *testing.T) {
+		// checksum of flow equals to source port is zero, which must be
+		// constant across probes as well.
+		sess, transport := newTestSession(t)
+		opts := Options{Protocol: ProtocolICMP, Paris: true}
+		for _, flow := range []int{sess.srcPort, sess.srcPort + 1} {
+			for _, identify := range []int{1, 2, 65537} {
+				probe, matched := roundTrip(t, sess, transport, opts, identify, flow)
+				require.Equal(t, uint16(sess.srcPort^flow), binary.BigEndian.Uint16(probe.Payload[icmpChecksumOffset:]), identify)
+				require.Equal(t, uint16(identify), matched, identify)
+			}
+		}
+	})
+
+	t.Run("too-small", func(t *testing.T) {
+		// one byte of payload leaves no room for pinning the checksum
+		sess, _ := newTestSession(t)
+		for _, opts := range []Options{
+			{Protocol: ProtocolUDP, Paris: true, PacketSize: 1},
+			{Protocol: ProtocolICMP, Paris: true, PacketSize: 1},
+		} {
+			_, err := sess.server.Traceroute(context.Background(), testDst.String(), opts)
+			require.Error(t, err, "%+v", opts)
+			_, err = sess.sendProbe(opts, 1, 1, 0, make([]byte, opts.PacketSize))
+			require.Error(t, err, "%+v", opts)
+		}
+	})
+}
+
+func TestSession_Echo(t *testing.T) {
+	sess, transport := newTestSession(t)
+	opts := Options{Protocol: ProtocolICMP}
+	_, err := sess.sendProbe(opts, 7, 2, 0, make([]byte, 32))
+	require.NoError(t, err)
+	probe := <-transport.probes
+	require.Equal(t, protocolICMPv4, probe.Protocol)
+	require.Equal(t, 2, probe.TTL)
+
+	msg, err := icmp.ParseMessage(protocolICMPv4, probe.Payload)
+	require.NoError(t, err)
+	require.Equal(t, ipv4.ICMPTypeEcho, msg.Type)
+	echo := msg.Body.(*icmp.Echo)
+	require.Equal(t, sess.echoID, echo.ID)
+	require.Equal(t, 7, echo.Seq)
+
+	// Time Exceeded from router quotes the echo request
+	transport.reply(t, testRouter, timeExceeded(t, probe))
+	pkt := <-sess.packetQ
+	require.True(t, pkt.addr.IP.Equal(testRouter))
+	identify, ok := sess.probeIdentify(pkt, opts)
+	require.True(t, ok)
+	require.Equal(t, uint16(7), identify)
+
+	// Echo Reply from destination carries ID and sequence itself
+	transport.reply(t, testDst, icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: &icmp.Echo{ID: echo.ID, Seq: echo.Seq, Data: echo.Data}})
+	pkt = <-sess.packetQ
+	require.True(t, pkt.addr.IP.Equal(testDst))
+	identify, ok = sess.probeIdentify(pkt, opts)
+	require.True(t, ok)
+	require.Equal(t, uint16(7), identify)
+
+	// Echo Reply of another ID belongs to no session, and Echo Request isn't
+	// a reply at all, so only the Echo Reply after them is delivered
+	transport.reply(t, testDst, icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: &icmp.Echo{ID: echo.ID ^ 1, Seq: echo.Seq}})
+	transport.reply(t, testDst, icmp.Message{Type: ipv4.ICMPTypeEcho, Body: &icmp.Echo{ID: echo.ID, Seq: 8}})
+	transport.reply(t, testDst, icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: &icmp.Echo{ID: echo.ID, Seq: 9}})
+	pkt = <-sess.packetQ
+	identify, ok = sess.probeIdentify(pkt, opts)
+	require.True(t, ok)
+	require.Equal(t, uint16(9), identify)
+}
+
+func TestSession_BeyondDestination(t *testing.T) {
+	// destination is 3 hops away, and replies to the probe of TTL 4 first
+	sess, transport := newTestSession(t)
+	opts := Options{Protocol: ProtocolUDP, MaxHop: 5, Window: 5, Attempts: 1, Timeout: time.Second}
+	opts.init()
+	result := Result{DstIP: testDst, Opts: opts}
+	errCh := make(chan error, 1)
+	go func() { errCh <- sess.runWindow(&result) }()
+
+	probes := make(map[int]Probe)
+	for i := 0; i < 5; i++ {
+		probe := <-transport.probes
+		probes[probe.TTL] = probe
+	}
+	transport.reply(t, testDst, portUnreachable(t, probes[4]))
+	transport.reply(t, net.IPv4(10, 0, 0, 1), timeExceeded(t, probes[1]))
+	transport.reply(t, net.IPv4(10, 0, 0, 2), timeExceeded(t, probes[2]))
+	transport.reply(t, testDst, portUnreachable(t, probes[3]))
+	require.NoError(t, <-errCh)
+	require.True(t, result.Reach)
+	require.Len(t, result.Hops, 3)
+
+	sess.future.mu.Lock()
+	defer sess.future.mu.Unlock()
+	var ttls []int
+	for _, event := range sess.future.events {
+		ttls = append(ttls, event.TTL)
+	}
+	require.Equal(t, []int{1, 2, 3}, ttls)
+}
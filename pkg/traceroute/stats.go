@@ -0,0 +1,55 @@
+package traceroute
+
+import "sync/atomic"
+
+// Stats is a snapshot of the packet counters of Server, which tells how much
+// of received traffic is replies to our probes.
+type Stats struct {
+	// Received is the number of packets received from Transport. TCP segments
+	// other than the SYN-ACK or RST sent to the source port of a running
+	// session are excluded, since raw TCP socket receives all TCP traffic on
+	// host.
+	Received uint64
+	// Matched is the number of replies matched to probes of sessions.
+	Matched uint64
+	// Unknown is the number of packets belonging to no running session, such
+	// as unsolicited ICMP messages or replies to other tools on host.
+	Unknown uint64
+	// Late is the number of replies arrived after their probes timed out.
+	Late uint64
+	// Malformed is the number of packets failed to be parsed.
+	Malformed uint64
+	// Duplicate is the number of replies to probes already replied.
+	Duplicate uint64
+	// Dropped is the number of replies dropped since session was too busy
+	// to accept them within Config.DispatchTimeout.
+	Dropped uint64
+}
+
+// stats holds the counters of Stats, which are updated atomically. It must be
+// 64-bit aligned, see Server.
+type stats struct {
+	received  uint64
+	matched   uint64
+	unknown   uint64
+	late      uint64
+	malformed uint64
+	duplicate uint64
+	dropped   uint64
+}
+
+func (s *stats) snapshot() Stats {
+	return Stats{
+		Received:  atomic.LoadUint64(&s.received),
+		Matched:   atomic.LoadUint64(&s.matched),
+		Unknown:   atomic.LoadUint64(&s.unknown),
+		Late:      atomic.LoadUint64(&s.late),
+		Malformed: atomic.LoadUint64(&s.malformed),
+		Duplicate: atomic.LoadUint64(&s.duplicate),
+		Dropped:   atomic.LoadUint64(&s.dropped),
+	}
+}
+
+func (s *stats) inc(counter *uint64) {
+	atomic.AddUint64(counter, 1)
+}
@@ -0,0 +1,319 @@
+package traceroute
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	tracerouteHeader = regexp.MustCompile(`^traceroute6? to (\S+) \(([^)]+)\), (\d+) hops max(?:, (\d+) byte packets)?`)
+	tracerouteHop    = regexp.MustCompile(`^\s*(\d+)\s+(.*)$`)
+	// mtrHop matches the hop lines of mtr report, "N.|-- host ..." (or
+	// "N. AS host ..." with AS numbers), and the lines of other nodes of the
+	// last hop, "|  `|-- host" for the first one and "|   +-- host" for the
+	// rest.
+	mtrHop = regexp.MustCompile(`^\s*(?:(\d+)\.(?:\|--)?|\|\s+(?:\x60\|--|\+--))\s+(.*)$`)
+)
+
+// ParseTraceroute parses the text output of classic Linux (or BSD)
+// traceroute into Result. Timeouts ("*"), multiple nodes per hop, hostnames
+// with addresses in parentheses and annotations ("!H", "!X", "!F-1400" etc.)
+// are recognized. The ICMP type of replies without annotation is inferred:
+// Time Exceeded for routers, and Port Unreachable of UDP probes for the
+// destination. Lines other than the header and hops are ignored.
+func ParseTraceroute(r io.Reader) (Result, error) {
+	var result Result
+	lastTTL := 0
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if m := tracerouteHeader.FindStringSubmatch(line); m != nil {
+			result.DstIP = net.ParseIP(m[2])
+			result.Opts.MaxHop, _ = strconv.Atoi(m[3])
+			result.Opts.PacketSize, _ = strconv.Atoi(m[4])
+			continue
+		}
+
+		ttl, fields := lastTTL, strings.Fields(line)
+		if m := tracerouteHop.FindStringSubmatch(line); m != nil {
+			ttl, _ = strconv.Atoi(m[1])
+			fields = strings.Fields(m[2])
+		} else if lastTTL == 0 || len(fields) == 0 || !startsWithSpace(line) {
+			continue // not a continuation of hop
+		}
+		if err := result.parseHop(ttl, fields); err != nil {
+			return Result{}, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		lastTTL = ttl
+	}
+	if err := scanner.Err(); err != nil {
+		return Result{}, err
+	}
+	if result.Opts.MaxHop == 0 {
+		result.Opts.MaxHop = lastTTL
+	}
+	return result, nil
+}
+
+// parseHop parses the fields of hop line after TTL, like
+// "host (192.0.2.1)  1.234 ms !H  *  192.0.2.2  2.345 ms".
+func (r *Result) parseHop(ttl int, fields []string) error {
+	r.hop(ttl)
+	type reply struct {
+		attempt int
+		Attempt
+	}
+	var replies []reply
+	var from net.IP
+	hostnames := make(map[string]string)
+	for i := 0; i < len(fields); i++ {
+		field := fields[i]
+		switch {
+		case field == "*":
+			r.attempt(ttl, nil)
+		case strings.HasPrefix(field, "!"):
+			// annotation of the last reply, "!" alone marks reply TTL <= 1
+			if n := len(replies); n > 0 && replies[n-1].attempt == len(r.hop(ttl).Attempts)-1 {
+				setAnnotation(&replies[n-1].Attempt, field)
+			}
+		case i+1 < len(fields) && fields[i+1] == "ms":
+			rtt, err := strconv.ParseFloat(field, 64)
+			if err != nil {
+				return fmt.Errorf("invalid rtt %q", field)
+			}
+			if from == nil {
+				return errors.New("rtt without address")
+			}
+			i++ // skip "ms"
+			replies = append(replies, reply{
+				attempt: r.attempt(ttl, nil),
+				Attempt: Attempt{Outcome: OutcomeReply, From: from, RTT: fromMillis(rtt)},
+			})
+		case i+1 < len(fields) && strings.HasPrefix(fields[i+1], "("):
+			if from = net.ParseIP(strings.Trim(fields[i+1], "()")); from == nil {
+				return fmt.Errorf("invalid address %q", fields[i+1])
+			}
+			if field != from.String() {
+				hostnames[from.String()] = field
+			}
+			i++ // skip address
+		default:
+			if from = net.ParseIP(field); from == nil {
+				return fmt.Errorf("unexpected field %q", field)
+			}
+		}
+	}
+
+	// replies are aggregated once their annotations are known
+	for _, reply := range replies {
+		r.inferICMP(&reply.Attempt)
+		r.aggregate(ttl, reply.attempt, reply.Attempt)
+	}
+	hop := r.hop(ttl)
+	for i := range hop.Nodes {
+		if hostname, ok := hostnames[hop.Nodes[i].IP.String()]; ok {
+			hop.Nodes[i].Hostname = hostname
+		}
+	}
+	return nil
+}
+
+// inferICMP fills the ICMP type and code of reply parsed from text without
+// annotation by whether it's from destination, assuming UDP probes.
+func (r *Result) inferICMP(attempt *Attempt) {
+	if attempt.ICMPType != 0 {
+		return
+	}
+	v6 := attempt.From.To4() == nil
+	switch {
+	case !attempt.From.Equal(r.DstIP):
+		attempt.ICMPType = 11 // time exceeded
+		if v6 {
+			attempt.ICMPType = 3
+		}
+	case v6:
+		attempt.ICMPType, attempt.ICMPCode = 1, 4 // port unreachable
+	default:
+		attempt.ICMPType, attempt.ICMPCode = 3, 3
+	}
+}
+
+// setAnnotation sets ICMP type and code of attempt by traceroute annotation,
+// it's the reverse of Attempt.Annotation.
+func setAnnotation(attempt *Attempt, annotation string) {
+	v6 := attempt.From.To4() == nil
+	codes := map[string][2]int{ // ICMPv4 and ICMPv6 destination unreachable codes
+		"!N": {0, 0},
+		"!H": {1, 3},
+		"!P": {2, -1},
+		"!S": {5, 2},
+		"!X": {13, 1},
+		"!V": {14, -1},
+		"!C": {15, -1},
+	}
+	typ := 3 // destination unreachable
+	if v6 {
+		typ = 1
+	}
+	switch {
+	case strings.HasPrefix(annotation, "!F"):
+		attempt.MTU, _ = strconv.Atoi(strings.TrimPrefix(annotation, "!F-"))
+		attempt.ICMPType, attempt.ICMPCode = typ, 4
+		if v6 {
+			attempt.ICMPType, attempt.ICMPCode = 2, 0 // packet too big
+		}
+	case strings.HasPrefix(annotation, "!<"):
+		code, err := strconv.Atoi(strings.Trim(annotation, "!<>"))
+		if err == nil {
+			attempt.ICMPType, attempt.ICMPCode = typ, code
+		}
+	default:
+		if c, ok := codes[annotation]; ok {
+			code := c[0]
+			if v6 {
+				code = c[1]
+			}
+			if code >= 0 {
+				attempt.ICMPType, attempt.ICMPCode = typ, code
+			}
+		}
+	}
+}
+
+// ParseMTRReport parses the output of "mtr --report" (or "--report-wide")
+// into Result, along with the statistics of hops in the report. Since mtr
+// doesn't keep RTTs of probes, the only RTT of node is the average one, and
+// the replies to hop are all counted for its first node. The destination is
+// the node of the last hop, as the report doesn't tell it.
+func ParseMTRReport(r io.Reader) (Result, []HopSummary, error) {
+	var result Result
+	var summaries []HopSummary
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		m := mtrHop.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+		fields := strings.Fields(m[2])
+		if m[1] == "" { // another node of the last hop
+			if len(summaries) == 0 || len(fields) == 0 {
+				continue
+			}
+			summary := &summaries[len(summaries)-1]
+			node := parseMTRHost(fields)
+			hop := result.hop(summary.TTL)
+			hop.Nodes = append(hop.Nodes, Node{IP: node.IP, Hostname: node.Hostname, ASN: node.ASN, Sent: hop.Sent})
+			summary.IPs = append(summary.IPs, node.IP)
+			continue
+		}
+
+		ttl, _ := strconv.Atoi(m[1])
+		if len(fields) < 8 {
+			return Result{}, nil, fmt.Errorf("line %d: too few columns", lineNo)
+		}
+		stats := fields[len(fields)-7:]
+		summary, err := parseMTRStats(ttl, stats)
+		if err != nil {
+			return Result{}, nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+
+		hop := result.hop(ttl)
+		hop.Sent, hop.Received = summary.Sent, summary.Received
+		for i := 0; i < summary.Sent; i++ {
+			outcome := OutcomeTimeout
+			if i < summary.Received {
+				outcome = OutcomeReply
+			}
+			hop.Attempts = append(hop.Attempts, Attempt{Outcome: outcome})
+		}
+		if node := parseMTRHost(fields[:len(fields)-7]); node.IP != nil || node.Hostname != "???" {
+			node.Sent, node.Received = summary.Sent, summary.Received
+			if summary.Received > 0 {
+				node.RTTs = []time.Duration{summary.Avg}
+			}
+			for i := 0; i < summary.Received; i++ {
+				hop.Attempts[i].From, hop.Attempts[i].RTT = node.IP, summary.Avg
+			}
+			hop.Nodes = append(hop.Nodes, node)
+			summary.IPs = []net.IP{node.IP}
+		}
+		summaries = append(summaries, summary)
+	}
+	if err := scanner.Err(); err != nil {
+		return Result{}, nil, err
+	}
+
+	if n := len(result.Hops); n > 0 {
+		last := result.Hops[n-1]
+		result.Opts.MaxHop = last.TTL
+		if len(last.Nodes) > 0 {
+			result.DstIP = last.Nodes[0].IP
+			result.Reach = last.Received > 0
+		}
+	}
+	for i := range result.Hops {
+		hop := &result.Hops[i]
+		for j := range hop.Attempts {
+			if hop.Attempts[j].Outcome == OutcomeReply && hop.Attempts[j].From != nil {
+				result.inferICMP(&hop.Attempts[j])
+			}
+		}
+	}
+	return result, summaries, nil
+}
+
+// parseMTRHost parses the host column of mtr report, which is an address or
+// a hostname, optionally followed by address in parentheses ("-b"), and
+// prefixed by AS number ("-z"). The host of hop not replied is "???".
+func parseMTRHost(fields []string) Node {
+	var node Node
+	if as := strings.TrimPrefix(fields[0], "AS"); len(fields) > 1 && as != fields[0] {
+		if asn, err := strconv.ParseUint(as, 10, 32); err == nil || as == "???" {
+			node.ASN = uint32(asn)
+			fields = fields[1:]
+		}
+	}
+	if len(fields) > 1 && strings.HasPrefix(fields[1], "(") {
+		node.IP = net.ParseIP(strings.Trim(fields[1], "()"))
+		node.Hostname = fields[0]
+	} else if node.IP = net.ParseIP(fields[0]); node.IP == nil {
+		node.Hostname = fields[0]
+	}
+	return node
+}
+
+// parseMTRStats parses the statistics columns of mtr report, which are
+// "Loss% Snt Last Avg Best Wrst StDev".
+func parseMTRStats(ttl int, fields []string) (HopSummary, error) {
+	var values [7]float64
+	for i, field := range fields {
+		v, err := strconv.ParseFloat(strings.TrimSuffix(field, "%"), 64)
+		if err != nil {
+			return HopSummary{}, fmt.Errorf("invalid column %q", field)
+		}
+		values[i] = v
+	}
+	summary := HopSummary{
+		TTL:    ttl,
+		Loss:   values[0],
+		Sent:   int(values[1]),
+		Last:   fromMillis(values[2]),
+		Avg:    fromMillis(values[3]),
+		Best:   fromMillis(values[4]),
+		Worst:  fromMillis(values[5]),
+		StdDev: fromMillis(values[6]),
+	}
+	summary.Received = int(float64(summary.Sent)*(100-summary.Loss)/100 + 0.5)
+	return summary, nil
+}
+
+func startsWithSpace(line string) bool {
+	return line != "" && (line[0] == ' ' || line[0] == '\t')
+}
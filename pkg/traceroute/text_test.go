@@ -0,0 +1,155 @@
+package traceroute_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/visonhuo/mykit/pkg/traceroute"
+)
+
+func TestParseTraceroute(t *testing.T) {
+	const output = `traceroute to example.com (93.184.216.34), 30 hops max, 60 byte packets
+ 1  _gateway (192.168.1.1)  0.512 ms  0.480 ms  0.462 ms
+ 2  * * *
+ 3  10.0.0.1 (10.0.0.1)  5.123 ms 10.0.0.2 (10.0.0.2)  5.456 ms *
+ 4  edge.example.net (203.0.113.9)  9.800 ms !X  *  9.900 ms !X
+ 5  93.184.216.34 (93.184.216.34)  10.100 ms  10.200 ms  10.300 ms
+`
+	result, err := traceroute.ParseTraceroute(strings.NewReader(output))
+	require.NoError(t, err)
+	require.Equal(t, "93.184.216.34", result.DstIP.String())
+	require.True(t, result.Reach)
+	require.Equal(t, 30, result.Opts.MaxHop)
+	require.Equal(t, 60, result.Opts.PacketSize)
+	require.Len(t, result.Hops, 5)
+
+	hop := result.Hops[0]
+	require.Equal(t, 3, hop.Sent)
+	require.Equal(t, 3, hop.Received)
+	require.Len(t, hop.Nodes, 1)
+	require.Equal(t, "_gateway", hop.Nodes[0].Hostname)
+	require.Equal(t, []time.Duration{512 * time.Microsecond, 480 * time.Microsecond, 462 * time.Microsecond}, hop.Nodes[0].RTTs)
+	require.Equal(t, 11, hop.Attempts[0].ICMPType)
+
+	hop = result.Hops[1]
+	require.Equal(t, 3, hop.Sent)
+	require.Empty(t, hop.Nodes)
+	for _, attempt := range hop.Attempts {
+		require.Equal(t, traceroute.OutcomeTimeout, attempt.Outcome)
+	}
+
+	hop = result.Hops[2]
+	require.Len(t, hop.Nodes, 2)
+	require.Equal(t, "10.0.0.1", hop.Nodes[0].IP.String())
+	require.Empty(t, hop.Nodes[0].Hostname)
+	require.Equal(t, "10.0.0.2", hop.Nodes[1].IP.String())
+	require.Equal(t, traceroute.OutcomeTimeout, hop.Attempts[2].Outcome)
+	require.Equal(t, 2, hop.Received)
+
+	hop = result.Hops[3]
+	require.Equal(t, "edge.example.net", hop.Nodes[0].Hostname)
+	require.Equal(t, "!X", hop.Attempts[0].Annotation())
+	require.Equal(t, traceroute.OutcomeTimeout, hop.Attempts[1].Outcome)
+	require.Equal(t, "!X", hop.Attempts[2].Annotation())
+
+	hop = result.Hops[4]
+	require.Equal(t, 3, hop.Attempts[0].ICMPType)
+	require.Equal(t, 3, hop.Attempts[0].ICMPCode)
+	require.Empty(t, hop.Attempts[0].Annotation())
+	require.Equal(t, 10200*time.Microsecond, result.Stats().Median)
+}
+
+func TestParseTraceroute_Annotations(t *testing.T) {
+	const output = `traceroute to 192.0.2.9 (192.0.2.9), 5 hops max
+ 1  192.0.2.1  1.000 ms !H  1.100 ms !N  1.200 ms !P
+ 2  192.0.2.2  2.000 ms !F-1400  2.100 ms !<16>  2.200 ms !
+`
+	result, err := traceroute.ParseTraceroute(strings.NewReader(output))
+	require.NoError(t, err)
+	require.False(t, result.Reach)
+	require.Len(t, result.Hops, 2)
+
+	var annotations []string
+	for _, hop := range result.Hops {
+		for _, attempt := range hop.Attempts {
+			annotations = append(annotations, attempt.Annotation())
+		}
+	}
+	require.Equal(t, []string{"!H", "!N", "!P", "!F-1400", "!<16>", ""}, annotations)
+	require.Equal(t, 1400, result.Hops[1].Attempts[0].MTU)
+}
+
+func TestParseTraceroute_Continuation(t *testing.T) {
+	// BSD traceroute prints other nodes of hop in new lines
+	const output = `traceroute to 192.0.2.9 (192.0.2.9), 64 hops max, 52 byte packets
+ 1  192.0.2.1 (192.0.2.1)  1.000 ms
+    192.0.2.2 (192.0.2.2)  1.100 ms  1.200 ms
+ 2  192.0.2.9 (192.0.2.9)  2.000 ms  2.100 ms  2.200 ms
+`
+	result, err := traceroute.ParseTraceroute(strings.NewReader(output))
+	require.NoError(t, err)
+	require.Len(t, result.Hops, 2)
+	require.Equal(t, 3, result.Hops[0].Sent)
+	require.Len(t, result.Hops[0].Nodes, 2)
+	require.Equal(t, 2, result.Hops[0].Nodes[1].Received)
+	require.True(t, result.Reach)
+
+	_, err = traceroute.ParseTraceroute(strings.NewReader(" 1  1.000 ms\n"))
+	require.Error(t, err)
+}
+
+func TestParseMTRReport(t *testing.T) {
+	// output of "mtr --report --show-ips", the other nodes of a load balanced
+	// hop are listed below it
+	const output = "Start: 2022-10-17T10:00:00+0000\n" +
+		"HOST: myhost                      Loss%   Snt   Last   Avg  Best  Wrst StDev\n" +
+		"  1.|-- _gateway (192.168.1.1)     0.0%    10    0.5   0.6   0.4   0.9   0.1\n" +
+		"  2.|-- ???                       100.0    10    0.0   0.0   0.0   0.0   0.0\n" +
+		"  3.|-- 10.0.0.1                  20.0%    10    5.1   5.3   5.0   6.0   0.3\n" +
+		"    |  `|-- 10.0.0.2\n" +
+		"    |   +-- 10.0.0.3\n" +
+		"  4.|-- 93.184.216.34              0.0%    10   10.1  10.2  10.0  10.5   0.1\n"
+	result, summaries, err := traceroute.ParseMTRReport(strings.NewReader(output))
+	require.NoError(t, err)
+	require.Equal(t, "93.184.216.34", result.DstIP.String())
+	require.True(t, result.Reach)
+	require.Len(t, result.Hops, 4)
+	require.Len(t, summaries, 4)
+
+	hop := result.Hops[0]
+	require.Equal(t, "_gateway", hop.Nodes[0].Hostname)
+	require.Equal(t, "192.168.1.1", hop.Nodes[0].IP.String())
+	require.Equal(t, []time.Duration{600 * time.Microsecond}, hop.Nodes[0].RTTs)
+	require.Equal(t, 900*time.Microsecond, summaries[0].Worst)
+
+	hop = result.Hops[1]
+	require.Empty(t, hop.Nodes)
+	require.Equal(t, 10, hop.Sent)
+	require.Zero(t, hop.Received)
+
+	hop = result.Hops[2]
+	require.Equal(t, 8, hop.Received)
+	require.Len(t, hop.Nodes, 3)
+	require.Equal(t, 20.0, hop.Stats().Loss)
+	require.Equal(t, []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.3")}, summaries[2].IPs)
+
+	hop = result.Hops[3]
+	require.Equal(t, 3, hop.Attempts[0].ICMPType)
+	require.Equal(t, 10200*time.Microsecond, result.Stats().Avg)
+
+	// output of "mtr --report --aslookup"
+	result, _, err = traceroute.ParseMTRReport(strings.NewReader(
+		"  1. AS64500   10.0.0.1          0.0%    10    5.1   5.3   5.0   6.0   0.3\n" +
+			"  2. AS???     ???             100.0    10    0.0   0.0   0.0   0.0   0.0\n"))
+	require.NoError(t, err)
+	require.Len(t, result.Hops, 2)
+	require.Equal(t, uint32(64500), result.Hops[0].Nodes[0].ASN)
+	require.Equal(t, "10.0.0.1", result.Hops[0].Nodes[0].IP.String())
+	require.Empty(t, result.Hops[1].Nodes)
+
+	_, _, err = traceroute.ParseMTRReport(strings.NewReader("  1.|-- 10.0.0.1  0.0%  10  x  1  1  1  0\n"))
+	require.Error(t, err)
+}
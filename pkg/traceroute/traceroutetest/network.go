@@ -0,0 +1,516 @@
+// Package traceroutetest provides an in-memory virtual network for traceroute
+// testing. Network implements traceroute.Transport, it forwards probe packets
+// along a simulated topology and replies the ICMP (or TCP) packets that real
+// routers and hosts would, so that tests need neither root nor network.
+package traceroutetest
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	netpacket "github.com/visonhuo/mykit/internal/net/packet"
+	"github.com/visonhuo/mykit/pkg/traceroute"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	protocolICMPv4 = 1
+	protocolTCP    = 6
+	protocolICMPv6 = 58
+
+	// maxQuoteLen is the length of original datagram quoted by ICMP errors.
+	maxQuoteLen = 128
+	// replyTTL is the initial TTL of replies.
+	replyTTL = 64
+)
+
+// Router forwards probes towards destination, and replies ICMP Time Exceeded
+// when TTL of probe expires.
+type Router struct {
+	IP net.IP
+	// Silent router forwards probes but never sends any ICMP message.
+	Silent bool
+	// PerPacket router balances load among equal-cost next hops per packet,
+	// rather than per flow.
+	PerPacket bool
+	// NAT router translates the source address of forwarded probes to
+	// NATAddr, and rewrites their IPv4 ID. Quoted source address of ICMP
+	// errors returned through it is translated back, but quoted ID isn't.
+	NAT     bool
+	NATAddr net.IP
+	// Extensions are attached to ICMP Time Exceeded messages of router,
+	// such as MPLS label stack or interface information.
+	Extensions []icmp.Extension
+	// Unreachable is the ICMP Destination Unreachable code that router
+	// replies to every probe instead of forwarding it, if it's non-zero.
+	Unreachable int
+}
+
+// Host is a probe destination. It replies ICMP Port Unreachable to UDP probes,
+// Echo Reply to ICMP probes, and SYN-ACK (open port) or RST to TCP probes.
+type Host struct {
+	IP net.IP
+	// Silent host drops every probe, like a firewall does.
+	Silent    bool
+	OpenPorts []int
+}
+
+// Link connects two nodes of network, it applies to both directions.
+type Link struct {
+	Latency time.Duration
+	// Loss is the probability that a packet traversing the link is dropped.
+	Loss float64
+	// MTU is the maximum length of IP packets traversing the link, zero for
+	// unlimited. The router forwarding a greater packet which must not be
+	// fragmented replies ICMP "fragmentation needed" (or ICMPv6 "packet too
+	// big") with the MTU, unless it's silent.
+	MTU int
+}
+
+// Network is an in-memory network rooted at the local source node of probes.
+// Packets are forwarded along shortest paths (in hops) towards destination,
+// equal-cost paths are balanced by flow hash.
+type Network struct {
+	mu      sync.Mutex
+	src     string
+	routers map[string]*Router
+	hosts   map[string]*Host
+	links   map[string]map[string]*Link
+	rand    *rand.Rand
+	natID   int
+	replyQ  chan reply
+	close   chan struct{}
+	once    sync.Once
+}
+
+type reply struct {
+	reply traceroute.Reply
+	bytes []byte
+}
+
+// NewNetwork returns an empty network whose probes are sent from src. Random
+// decisions (loss, per packet load balancing) are made by a source of seed.
+func NewNetwork(src string, seed int64) *Network {
+	return &Network{
+		src:     src,
+		routers: make(map[string]*Router),
+		hosts:   make(map[string]*Host),
+		links:   map[string]map[string]*Link{src: {}},
+		rand:    rand.New(rand.NewSource(seed)),
+		replyQ:  make(chan reply, 1024),
+		close:   make(chan struct{}),
+	}
+}
+
+// AddRouter adds a router of ip to network, and returns it for configuration.
+func (n *Network) AddRouter(ip string) *Router {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	router := &Router{IP: net.ParseIP(ip)}
+	n.routers[ip] = router
+	if _, ok := n.links[ip]; !ok {
+		n.links[ip] = make(map[string]*Link)
+	}
+	return router
+}
+
+// AddHost adds a host of ip to network, and returns it for configuration.
+func (n *Network) AddHost(ip string) *Host {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	host := &Host{IP: net.ParseIP(ip)}
+	n.hosts[ip] = host
+	if _, ok := n.links[ip]; !ok {
+		n.links[ip] = make(map[string]*Link)
+	}
+	return host
+}
+
+// Connect links node a and b with latency, both nodes must have been added.
+func (n *Network) Connect(a, b string, latency time.Duration) *Link {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.links[a] == nil || n.links[b] == nil {
+		panic("traceroutetest: connect unknown node " + a + " - " + b)
+	}
+	link := &Link{Latency: latency}
+	n.links[a][b] = link
+	n.links[b][a] = link
+	return link
+}
+
+// Chain connects nodes one by one with latency, it's a shortcut to describe
+// linear paths.
+func (n *Network) Chain(latency time.Duration, nodes ...string) {
+	for i := 1; i < len(nodes); i++ {
+		n.Connect(nodes[i-1], nodes[i], latency)
+	}
+}
+
+// Send implements traceroute.Transport. The probe is forwarded hop by hop
+// until its TTL expires or it arrives at destination, the reply (if any) is
+// delivered to Recv after the round trip latency.
+func (n *Network) Send(probe traceroute.Probe) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	select {
+	case <-n.close:
+		return errors.New("network closed")
+	default:
+	}
+
+	dst := probe.Dst.String()
+	dist := n.distances(dst)
+	if _, ok := dist[n.src]; !ok {
+		return nil // no route to destination
+	}
+
+	pkt := probe
+	var path []*Link
+	var latency time.Duration
+	var nat *Router
+	cur := n.src
+	for {
+		next := n.nextHop(cur, dist, &pkt)
+		link, ok := n.links[cur][next]
+		if !ok {
+			return nil
+		}
+		if link.MTU > 0 && packetLen(pkt) > link.MTU && (pkt.DontFragment || pkt.Dst.To4() == nil) {
+			router := n.routers[cur]
+			if router == nil { // the source
+				return errors.New("message too long")
+			}
+			if router.Silent {
+				return nil
+			}
+			mtu := link.MTU
+			return n.reply(probe, pkt, nat, path, latency, func(probe traceroute.Probe) (net.IP, []byte, int, error) {
+				return n.tooBig(router.IP, mtu, probe)
+			})
+		}
+		if n.lost(link) {
+			return nil
+		}
+		path = append(path, link)
+		latency += link.Latency
+		cur = next
+
+		if cur == dst {
+			if host, ok := n.hosts[cur]; ok && host.Silent {
+				return nil
+			}
+			if router, ok := n.routers[cur]; ok && router.Silent {
+				return nil
+			}
+			return n.reply(probe, pkt, nat, path, latency, n.arrive)
+		}
+		router := n.routers[cur]
+		if router == nil { // hosts don't forward packets
+			return nil
+		}
+		if router.Unreachable != 0 && !router.Silent {
+			return n.reply(probe, pkt, nat, path, latency, func(probe traceroute.Probe) (net.IP, []byte, int, error) {
+				return n.unreachable(router.IP, router.Unreachable, probe)
+			})
+		}
+		if pkt.TTL <= 1 {
+			if router.Silent {
+				return nil
+			}
+			return n.reply(probe, pkt, nat, path, latency, func(probe traceroute.Probe) (net.IP, []byte, int, error) {
+				return n.timeExceeded(router, probe)
+			})
+		}
+		pkt.TTL--
+		if router.NAT && nat == nil {
+			nat = router
+			pkt.Src = router.NATAddr
+			n.natID++
+			pkt.ID = n.natID & 0xffff
+		}
+	}
+}
+
+// Recv implements traceroute.Transport.
+func (n *Network) Recv(b []byte) (traceroute.Reply, error) {
+	select {
+	case <-n.close:
+		return traceroute.Reply{}, errors.New("network closed")
+	case r := <-n.replyQ:
+		r.reply.N = copy(b, r.bytes)
+		r.reply.RecvTime = time.Now()
+		return r.reply, nil
+	}
+}
+
+// Close implements traceroute.Transport.
+func (n *Network) Close() error {
+	n.once.Do(func() { close(n.close) })
+	return nil
+}
+
+// distances returns hop count from every node to dst.
+func (n *Network) distances(dst string) map[string]int {
+	dist := make(map[string]int)
+	if _, ok := n.links[dst]; !ok {
+		return dist
+	}
+	dist[dst] = 0
+	queue := []string{dst}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for next := range n.links[cur] {
+			if _, ok := dist[next]; ok {
+				continue
+			}
+			// only routers (and the source) forward packets
+			if _, ok := n.routers[next]; ok || next == n.src {
+				dist[next] = dist[cur] + 1
+				queue = append(queue, next)
+			}
+		}
+	}
+	return dist
+}
+
+func (n *Network) nextHop(cur string, dist map[string]int, pkt *traceroute.Probe) string {
+	var candidates []string
+	for next := range n.links[cur] {
+		if d, ok := dist[next]; ok && d == dist[cur]-1 {
+			candidates = append(candidates, next)
+		}
+	}
+	sort.Strings(candidates)
+	if len(candidates) == 0 {
+		return ""
+	}
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+	if router, ok := n.routers[cur]; ok && router.PerPacket {
+		return candidates[n.rand.Intn(len(candidates))]
+	}
+	return candidates[flowHash(cur, pkt)%uint64(len(candidates))]
+}
+
+func (n *Network) lost(link *Link) bool {
+	return link.Loss > 0 && n.rand.Float64() < link.Loss
+}
+
+// reply builds the reply of probe by fn, and schedules its delivery back
+// along path.
+func (n *Network) reply(origin, pkt traceroute.Probe, nat *Router, path []*Link, latency time.Duration,
+	fn func(traceroute.Probe) (net.IP, []byte, int, error)) error {
+	for i := len(path) - 1; i >= 0; i-- {
+		if n.lost(path[i]) {
+			return nil
+		}
+	}
+	if nat != nil { // translate destination of reply (and quoted source) back
+		pkt.Src = origin.Src
+	}
+	from, b, proto, err := fn(pkt)
+	if err != nil || b == nil {
+		return err
+	}
+
+	// reply is forwarded back by every router along path but the replying one
+	r := reply{reply: traceroute.Reply{Protocol: proto, From: from, TTL: replyTTL - len(path) + 1}, bytes: b}
+	time.AfterFunc(2*latency, func() {
+		select {
+		case <-n.close:
+		case n.replyQ <- r:
+		}
+	})
+	return nil
+}
+
+// arrive replies probe arrived at destination.
+func (n *Network) arrive(probe traceroute.Probe) (net.IP, []byte, int, error) {
+	switch probe.Protocol {
+	case protocolICMPv4, protocolICMPv6:
+		msg, err := icmp.ParseMessage(probe.Protocol, probe.Payload)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		if msg.Type != ipv4.ICMPTypeEcho && msg.Type != ipv6.ICMPTypeEchoRequest {
+			return nil, nil, 0, nil
+		}
+		msg.Type = ipv4.ICMPTypeEchoReply
+		if probe.Protocol == protocolICMPv6 {
+			msg.Type = ipv6.ICMPTypeEchoReply
+		}
+		b, err := n.marshal(probe.Dst, probe.Src, msg)
+		return probe.Dst, b, probe.Protocol, err
+
+	case protocolTCP:
+		return n.tcpReply(probe)
+
+	default:
+		return n.portUnreachable(probe)
+	}
+}
+
+func (n *Network) timeExceeded(router *Router, probe traceroute.Probe) (net.IP, []byte, int, error) {
+	body := &icmp.TimeExceeded{Data: quote(probe), Extensions: router.Extensions}
+	msg := icmp.Message{Type: ipv4.ICMPTypeTimeExceeded, Body: body}
+	if probe.Dst.To4() == nil {
+		msg.Type = ipv6.ICMPTypeTimeExceeded
+	}
+	b, err := n.marshal(router.IP, probe.Src, &msg)
+	return router.IP, b, icmpProtocol(probe), err
+}
+
+func (n *Network) portUnreachable(probe traceroute.Probe) (net.IP, []byte, int, error) {
+	code := 3
+	if probe.Dst.To4() == nil {
+		code = 4
+	}
+	return n.unreachable(probe.Dst, code, probe)
+}
+
+func (n *Network) unreachable(from net.IP, code int, probe traceroute.Probe) (net.IP, []byte, int, error) {
+	msg := icmp.Message{Type: ipv4.ICMPTypeDestinationUnreachable, Code: code, Body: &icmp.DstUnreach{Data: quote(probe)}}
+	if probe.Dst.To4() == nil {
+		msg.Type = ipv6.ICMPTypeDestinationUnreachable
+	}
+	b, err := n.marshal(from, probe.Src, &msg)
+	return from, b, icmpProtocol(probe), err
+}
+
+func (n *Network) tooBig(from net.IP, mtu int, probe traceroute.Probe) (net.IP, []byte, int, error) {
+	if probe.Dst.To4() == nil {
+		msg := icmp.Message{Type: ipv6.ICMPTypePacketTooBig, Body: &icmp.PacketTooBig{MTU: mtu, Data: quote(probe)}}
+		b, err := n.marshal(from, probe.Src, &msg)
+		return from, b, protocolICMPv6, err
+	}
+	msg := icmp.Message{Type: ipv4.ICMPTypeDestinationUnreachable, Code: 4, Body: &icmp.DstUnreach{Data: quote(probe)}}
+	b, err := n.marshal(from, probe.Src, &msg)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	// next-hop MTU is carried by the unused field of header (RFC 1191)
+	binary.BigEndian.PutUint16(b[6:8], uint16(mtu))
+	b[2], b[3] = 0, 0
+	binary.BigEndian.PutUint16(b[2:4], checksum(b))
+	return from, b, protocolICMPv4, nil
+}
+
+func (n *Network) tcpReply(probe traceroute.Probe) (net.IP, []byte, int, error) {
+	var syn netpacket.TCPv4
+	if err := syn.Unmarshal(probe.Payload); err != nil || !syn.HasFlags(netpacket.TCPFlagSYN) {
+		return nil, nil, 0, err
+	}
+	resp := netpacket.TCPv4{
+		SrcPort: syn.DstPort,
+		DstPort: syn.SrcPort,
+		Ack:     syn.Seq + 1,
+		Flags:   netpacket.TCPFlagRST | netpacket.TCPFlagACK,
+	}
+	if host, ok := n.hosts[probe.Dst.String()]; ok {
+		for _, port := range host.OpenPorts {
+			if port == int(syn.DstPort) {
+				resp.Seq = n.rand.Uint32()
+				resp.Flags = netpacket.TCPFlagSYN | netpacket.TCPFlagACK
+			}
+		}
+	}
+	header := ipv4.Header{Protocol: protocolTCP, Src: probe.Dst, Dst: probe.Src}
+	b, err := resp.Marshal(header, nil)
+	return probe.Dst, b, protocolTCP, err
+}
+
+func (n *Network) marshal(from, to net.IP, msg *icmp.Message) ([]byte, error) {
+	if to.To4() != nil {
+		return msg.Marshal(nil)
+	}
+	return msg.Marshal(icmp.IPv6PseudoHeader(from, to))
+}
+
+// packetLen returns the IP packet length of probe.
+func packetLen(probe traceroute.Probe) int {
+	if probe.Dst.To4() == nil {
+		return ipv6.HeaderLen + len(probe.Payload)
+	}
+	return ipv4.HeaderLen + len(probe.Payload)
+}
+
+// checksum returns the Internet checksum of b.
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+func icmpProtocol(probe traceroute.Probe) int {
+	if probe.Dst.To4() == nil {
+		return protocolICMPv6
+	}
+	return protocolICMPv4
+}
+
+// quote returns the original datagram of probe quoted by ICMP errors.
+func quote(probe traceroute.Probe) []byte {
+	var b []byte
+	if probe.Dst.To4() != nil {
+		header := ipv4.Header{
+			Version:  ipv4.Version,
+			Len:      ipv4.HeaderLen,
+			TotalLen: ipv4.HeaderLen + len(probe.Payload),
+			ID:       probe.ID,
+			TTL:      probe.TTL,
+			Protocol: probe.Protocol,
+			Src:      probe.Src,
+			Dst:      probe.Dst,
+		}
+		if probe.DontFragment {
+			header.Flags = ipv4.DontFragment
+		}
+		b, _ = header.Marshal()
+	} else {
+		b = make([]byte, ipv6.HeaderLen)
+		b[0] = ipv6.Version << 4
+		binary.BigEndian.PutUint16(b[4:6], uint16(len(probe.Payload)))
+		b[6], b[7] = byte(probe.Protocol), byte(probe.TTL)
+		copy(b[8:24], probe.Src.To16())
+		copy(b[24:40], probe.Dst.To16())
+	}
+	b = append(b, probe.Payload...)
+	if len(b) > maxQuoteLen {
+		b = b[:maxQuoteLen]
+	}
+	return b
+}
+
+// flowHash hashes the flow identifier of pkt (addresses, protocol, and the
+// first 4 bytes of transport header, which are ports for UDP/TCP, or type,
+// code and checksum for ICMP) salted by router, like ECMP routers do.
+func flowHash(router string, pkt *traceroute.Probe) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(router))
+	_, _ = h.Write(pkt.Src.To16())
+	_, _ = h.Write(pkt.Dst.To16())
+	_, _ = h.Write([]byte{byte(pkt.Protocol)})
+	if len(pkt.Payload) >= 4 {
+		_, _ = h.Write(pkt.Payload[:4])
+	}
+	return h.Sum64()
+}
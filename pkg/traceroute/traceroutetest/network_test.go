@@ -0,0 +1,66 @@
+package traceroutetest_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/visonhuo/mykit/pkg/traceroute"
+	"github.com/visonhuo/mykit/pkg/traceroute/traceroutetest"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+func TestNetwork(t *testing.T) {
+	network := traceroutetest.NewNetwork("192.0.2.1", 1)
+	defer network.Close()
+	nat := network.AddRouter("10.0.0.1")
+	nat.NAT, nat.NATAddr = true, net.ParseIP("203.0.113.1")
+	network.AddRouter("10.0.1.1")
+	network.AddHost("198.51.100.1")
+	network.Chain(time.Millisecond, "192.0.2.1", "10.0.0.1", "10.0.1.1", "198.51.100.1")
+
+	for ttl, want := range map[int]struct {
+		from     string
+		icmpType ipv4.ICMPType
+		sameID   bool
+	}{
+		1: {"10.0.0.1", ipv4.ICMPTypeTimeExceeded, true},
+		2: {"10.0.1.1", ipv4.ICMPTypeTimeExceeded, false},
+		3: {"198.51.100.1", ipv4.ICMPTypeDestinationUnreachable, false},
+	} {
+		probe := traceroute.Probe{
+			Protocol: 17,
+			Src:      net.ParseIP("192.0.2.1"),
+			Dst:      net.ParseIP("198.51.100.1"),
+			TTL:      ttl,
+			ID:       1000 + ttl,
+			Payload:  []byte{0x75, 0x30, 0x82, 0x9a, 0, 8, 0, 0},
+		}
+		require.NoError(t, network.Send(probe))
+
+		b := make([]byte, 1500)
+		reply, err := network.Recv(b)
+		require.NoError(t, err)
+		require.Equal(t, want.from, reply.From.String())
+		require.GreaterOrEqual(t, time.Since(reply.RecvTime), time.Duration(0))
+
+		msg, err := icmp.ParseMessage(reply.Protocol, b[:reply.N])
+		require.NoError(t, err)
+		require.Equal(t, want.icmpType, msg.Type)
+		var data []byte
+		switch body := msg.Body.(type) {
+		case *icmp.TimeExceeded:
+			data = body.Data
+		case *icmp.DstUnreach:
+			data = body.Data
+		}
+		quoted, err := ipv4.ParseHeader(data)
+		require.NoError(t, err)
+		// quoted source is translated back by NAT, but ID isn't
+		require.True(t, probe.Src.Equal(quoted.Src))
+		require.Equal(t, want.sameID, quoted.ID == probe.ID)
+		require.Equal(t, probe.Payload, data[ipv4.HeaderLen:])
+	}
+}
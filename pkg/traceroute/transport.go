@@ -0,0 +1,315 @@
+package traceroute
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Transport sends probe packets and receives reply packets for a Server.
+// Implementations must be safe for concurrent use of Send and Recv.
+type Transport interface {
+	// Send sends the probe packet to network.
+	Send(probe Probe) error
+	// Recv blocks until a reply packet is received and copied into b.
+	// Any error returned by Recv shuts the Server down.
+	Recv(b []byte) (Reply, error)
+	// Close closes the transport, and unblocks any pending Recv call.
+	Close() error
+}
+
+// Probe is an outgoing probe packet. Payload is the transport layer packet
+// (header included) carried by IP datagram.
+type Probe struct {
+	Protocol     int // IANA protocol number of payload
+	Src          net.IP
+	Dst          net.IP
+	TTL          int // TTL for IPv4, or hop limit for IPv6
+	ID           int // identification, only available for IPv4
+	DontFragment bool
+	Payload      []byte
+}
+
+// Reply describes an incoming reply packet. Reply packet is an ICMP message
+// (without IP header) if Protocol is ICMPv4 or ICMPv6, or a TCP segment if
+// Protocol is TCP.
+type Reply struct {
+	Protocol int // IANA protocol number of reply packet
+	N        int // length of reply packet
+	From     net.IP
+	RecvTime time.Time
+	// TTL is the TTL (or hop limit) of reply packet when it's received, or
+	// zero if transport doesn't know it.
+	TTL int
+}
+
+type rawReply struct {
+	reply Reply
+	bytes []byte // pooled buffer, of which the first reply.N bytes are read
+	err   error
+}
+
+type rawTransport struct {
+	network  string
+	icmpConn *icmp.PacketConn
+	wConn    *ipv4.RawConn
+	wConn6   *ipv6.PacketConn
+	tcpConn  net.PacketConn
+	tcpMu    sync.Mutex
+	replyQ   chan rawReply
+	bufPool  sync.Pool
+	close    chan struct{}
+	shutdown sync.Once
+}
+
+// NewRawTransport returns the default Transport of Server, which sends and
+// receives packets by raw sockets of network (NetworkIPv4 or NetworkIPv6),
+// so it requires root privilege (or CAP_NET_RAW on Linux).
+func NewRawTransport(network string, localSrcIP net.IP) (Transport, error) {
+	t := &rawTransport{
+		network: network,
+		replyQ:  make(chan rawReply),
+		close:   make(chan struct{}),
+		bufPool: sync.Pool{New: func() interface{} {
+			return make([]byte, 1500)
+		}},
+	}
+	for _, fn := range []func(net.IP) error{
+		t.setupReadConn,
+		t.setupWriteConn,
+	} {
+		if err := fn(localSrcIP); err != nil {
+			_ = t.Close()
+			return nil, err
+		}
+	}
+
+	if t.isIPv6() {
+		go t.serve(readIPv6(t.icmpConn.IPv6PacketConn()), protocolICMPv6)
+	} else {
+		go t.serve(readIPv4(t.icmpConn.IPv4PacketConn()), protocolICMPv4)
+	}
+	return t, nil
+}
+
+func (t *rawTransport) setupReadConn(net.IP) error {
+	network, address := "ip4:icmp", net.IPv4zero.String()
+	if t.isIPv6() {
+		network, address = "ip6:ipv6-icmp", net.IPv6unspecified.String()
+	}
+	conn, err := icmp.ListenPacket(network, address)
+	if err != nil {
+		return err
+	}
+	t.icmpConn = conn
+	// The outer IP header is stripped from ICMP messages, so the TTL of
+	// replies is received by control message.
+	if t.isIPv6() {
+		err = conn.IPv6PacketConn().SetControlMessage(ipv6.FlagHopLimit, true)
+	} else {
+		err = conn.IPv4PacketConn().SetControlMessage(ipv4.FlagTTL, true)
+	}
+	return err
+}
+
+func (t *rawTransport) setupWriteConn(localSrcIP net.IP) error {
+	if t.isIPv6() {
+		// IPv6 raw sockets don't support IP_HDRINCL, so the hop limit is
+		// specified by control message on every write instead.
+		udpConn, err := net.ListenPacket("ip6:udp", localSrcIP.String())
+		if err != nil {
+			return err
+		}
+		t.wConn6 = ipv6.NewPacketConn(udpConn)
+		return nil
+	}
+
+	udpConn, err := net.ListenPacket("ip4:udp", localSrcIP.String())
+	if err != nil {
+		return err
+	}
+	rawConn, err := ipv4.NewRawConn(udpConn)
+	if err != nil {
+		return err
+	}
+	t.wConn = rawConn
+	return nil
+}
+
+// setupTCPConn lazily listens for TCP segments, which are needed by TCP probe
+// mode only, since raw TCP socket receives a copy of all TCP traffic on host.
+func (t *rawTransport) setupTCPConn() error {
+	t.tcpMu.Lock()
+	defer t.tcpMu.Unlock()
+	if t.tcpConn != nil {
+		return nil
+	}
+	select {
+	case <-t.close:
+		return errors.New("transport closed")
+	default:
+	}
+
+	conn, err := net.ListenPacket("ip4:tcp", net.IPv4zero.String())
+	if err != nil {
+		return err
+	}
+	pconn := ipv4.NewPacketConn(conn)
+	if err := pconn.SetControlMessage(ipv4.FlagTTL, true); err != nil {
+		conn.Close()
+		return err
+	}
+	t.tcpConn = conn
+	go t.serve(readIPv4(pconn), protocolTCP)
+	return nil
+}
+
+// readFunc reads a packet into b, and returns its source address and TTL.
+type readFunc func(b []byte) (n int, from net.IP, ttl int, err error)
+
+func readIPv4(conn *ipv4.PacketConn) readFunc {
+	return func(b []byte) (int, net.IP, int, error) {
+		n, cm, addr, err := conn.ReadFrom(b)
+		if err != nil {
+			return 0, nil, 0, err
+		}
+		var ttl int
+		if cm != nil {
+			ttl = cm.TTL
+		}
+		return n, addr.(*net.IPAddr).IP, ttl, nil
+	}
+}
+
+func readIPv6(conn *ipv6.PacketConn) readFunc {
+	return func(b []byte) (int, net.IP, int, error) {
+		n, cm, addr, err := conn.ReadFrom(b)
+		if err != nil {
+			return 0, nil, 0, err
+		}
+		var hopLimit int
+		if cm != nil {
+			hopLimit = cm.HopLimit
+		}
+		return n, addr.(*net.IPAddr).IP, hopLimit, nil
+	}
+}
+
+func (t *rawTransport) serve(read readFunc, proto int) {
+	for {
+		buf := t.bufPool.Get().([]byte)
+		n, from, ttl, err := read(buf)
+		var reply rawReply
+		if err != nil {
+			t.bufPool.Put(buf)
+			reply.err = err
+		} else {
+			reply.bytes = buf
+			reply.reply = Reply{Protocol: proto, N: n, From: from, RecvTime: time.Now(), TTL: ttl}
+		}
+
+		select {
+		case <-t.close:
+			if reply.bytes != nil {
+				t.bufPool.Put(reply.bytes)
+			}
+			return
+		case t.replyQ <- reply:
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (t *rawTransport) Send(probe Probe) error {
+	if t.isIPv6() {
+		cm := ipv6.ControlMessage{HopLimit: probe.TTL, Src: probe.Src}
+		dst := &net.IPAddr{IP: probe.Dst}
+		switch probe.Protocol {
+		case protocolUDP:
+			_, err := t.wConn6.WriteTo(probe.Payload, &cm, dst)
+			return err
+		case protocolICMPv6:
+			// ICMPv6 probes are sent through the listening ICMPv6 endpoint,
+			// kernel fills the checksum for us.
+			_, err := t.icmpConn.IPv6PacketConn().WriteTo(probe.Payload, &cm, dst)
+			return err
+		default:
+			return errors.New("unsupported ipv6 probe protocol")
+		}
+	}
+
+	if probe.Protocol == protocolTCP {
+		if err := t.setupTCPConn(); err != nil {
+			return err
+		}
+	}
+	header := ipv4.Header{
+		Version:  ipv4.Version,
+		Len:      ipv4.HeaderLen,
+		TotalLen: ipv4.HeaderLen + len(probe.Payload),
+		ID:       probe.ID,
+		TTL:      probe.TTL,
+		Protocol: probe.Protocol,
+		Src:      probe.Src,
+		Dst:      probe.Dst,
+	}
+	if probe.DontFragment {
+		header.Flags = ipv4.DontFragment
+	}
+	return t.wConn.WriteTo(&header, probe.Payload, nil)
+}
+
+func (t *rawTransport) Recv(b []byte) (Reply, error) {
+	select {
+	case <-t.close:
+		return Reply{}, errors.New("transport closed")
+	case reply := <-t.replyQ:
+		if reply.err != nil {
+			return Reply{}, reply.err
+		}
+		reply.reply.N = copy(b, reply.bytes[:reply.reply.N])
+		t.bufPool.Put(reply.bytes)
+		return reply.reply, nil
+	}
+}
+
+func (t *rawTransport) Close() error {
+	var firstErr error
+	t.shutdown.Do(func() {
+		close(t.close)
+		if t.icmpConn != nil {
+			if err := t.icmpConn.Close(); err != nil {
+				firstErr = err
+			}
+		}
+		if t.wConn != nil {
+			if err := t.wConn.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		if t.wConn6 != nil {
+			if err := t.wConn6.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		t.tcpMu.Lock()
+		if t.tcpConn != nil {
+			if err := t.tcpConn.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		t.tcpMu.Unlock()
+	})
+	return firstErr
+}
+
+func (t *rawTransport) isIPv6() bool {
+	return t.network == NetworkIPv6
+}